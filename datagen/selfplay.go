@@ -0,0 +1,410 @@
+package datagen
+
+import (
+	"bufio"
+	"encoding/binary"
+	"eques/engine"
+	"eques/utils"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"os"
+	"strings"
+	"sync"
+)
+
+const (
+	SelfplayFormatCSV    = "csv"
+	SelfplayFormatBinary = "binary"
+
+	// The size of a position packed into the binary format, and the extension
+	// of files in that format.
+	PackedPositionSize  = 28
+	PackedFileExtension = ".bin"
+
+	SelfplayTTSize = 16
+
+	// Games running longer than this are adjudicated as draws, well before
+	// the search's position history could fill up.
+	SelfplayMaxPlies = 600
+
+	ReportEveryNSelfplayGames = 100
+)
+
+type SelfplayConfig struct {
+	OutFile    string
+	Format     string
+	NumGames   int
+	NumThreads int
+
+	// The limits of each move's search. A non-zero depth is searched to instead of
+	// the number of nodes.
+	Nodes uint64
+	Depth uint8
+
+	// The number of random moves played from the starting position, and the bound on
+	// the score of the position they lead to, past which the opening is thrown out.
+	RandomPlies     int
+	OpeningMaxScore int16
+
+	// Resign once the score has been past ResignScore in favor of the same side for
+	// ResignPlies plies in a row, and agree to a draw once it has been within
+	// DrawScore for DrawPlies plies in a row, but only after DrawMinPly plies. Zero
+	// plies turns either rule off.
+	ResignScore int16
+	ResignPlies int
+	DrawScore   int16
+	DrawPlies   int
+	DrawMinPly  int
+}
+
+// A position recorded from a self-play game, along with the search score, from
+// white's perspective, until the game's outcome is known.
+type SelfplayPosition struct {
+	Pos   engine.Position
+	Score int16
+}
+
+type selfplayGame struct {
+	positions []SelfplayPosition
+
+	// From white's perspective: 1.0 for a white win, 0.5 for a draw, and 0.0
+	// for a black win.
+	outcome float64
+}
+
+// Play games of the engine against itself, in as many goroutines as threads, and
+// write every quiet position of them, labelled with the search score and the outcome
+// of the game, into the output file. Both are from white's perspective.
+func Selfplay(config SelfplayConfig) {
+	if config.Nodes == 0 && config.Depth == 0 {
+		panic("self-play needs a node or depth limit for each move")
+	}
+
+	outFile, err := os.OpenFile(config.OutFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		panic(err)
+	}
+	defer outFile.Close()
+
+	writer := bufio.NewWriter(outFile)
+	if info, err := outFile.Stat(); err == nil && info.Size() == 0 && config.Format == SelfplayFormatCSV {
+		if _, err := writer.WriteString("fen,score,outcome\n"); err != nil {
+			panic(err)
+		}
+	}
+
+	games := make(chan selfplayGame, config.NumThreads)
+	var gamesLeft sync.WaitGroup
+	gamesLeft.Add(config.NumGames)
+
+	var gameCounter sync.Mutex
+	gamesStarted := 0
+	nextGame := func() bool {
+		gameCounter.Lock()
+		defer gameCounter.Unlock()
+		gamesStarted++
+		return gamesStarted <= config.NumGames
+	}
+
+	for i := 0; i < config.NumThreads; i++ {
+		go func() {
+			sd := engine.SearchData{Silent: true}
+			sd.TT.SetSize(SelfplayTTSize, engine.SearchEntrySize)
+			for nextGame() {
+				games <- playSelfplayGame(&sd, &config)
+			}
+		}()
+	}
+
+	go func() {
+		gamesLeft.Wait()
+		close(games)
+	}()
+
+	log.Printf("Playing %d games in %d threads", config.NumGames, config.NumThreads)
+
+	numGames, numPositions := 0, 0
+	var results [3]int
+	for game := range games {
+		for _, position := range game.positions {
+			writeSelfplayPosition(writer, &position, game.outcome, config.Format)
+		}
+
+		numGames++
+		numPositions += len(game.positions)
+		results[int(game.outcome*2)]++
+
+		if numGames%ReportEveryNSelfplayGames == 0 {
+			log.Printf(
+				"%d games played, %d positions recorded (+%d =%d -%d)",
+				numGames, numPositions, results[2], results[1], results[0],
+			)
+		}
+		gamesLeft.Done()
+	}
+
+	if err := writer.Flush(); err != nil {
+		panic(err)
+	}
+
+	log.Printf("Self-play completed, %d positions written to %s", numPositions, config.OutFile)
+	log.Printf("%d total games played (+%d =%d -%d)", numGames, results[2], results[1], results[0])
+}
+
+func playSelfplayGame(sd *engine.SearchData, config *SelfplayConfig) selfplayGame {
+	sd.Reset()
+	sd.TT.Clear()
+	playRandomOpening(sd, config)
+
+	game := selfplayGame{}
+	whiteWinPlies, blackWinPlies, drawPlies := 0, 0, 0
+
+	for ply := 0; ; ply++ {
+		legalMoves := engine.GenLegalMoves(&sd.Pos)
+		if len(legalMoves) == 0 {
+			game.outcome = 0.5
+			if sd.Pos.IsSideInCheck(sd.Pos.Side) {
+				game.outcome = float64(sd.Pos.Side)
+			}
+			return game
+		}
+
+		if ply >= SelfplayMaxPlies || gameIsDrawn(sd) {
+			game.outcome = 0.5
+			return game
+		}
+
+		sd.Limits = engine.SearchLimits{Nodes: config.Nodes}
+		if config.Depth > 0 {
+			sd.Limits = engine.SearchLimits{Depth: config.Depth}
+		}
+		sd.Timer.CalculateSearchTime(engine.InfiniteTimeFormat, 0, 0, 0, 0)
+		move := engine.Search(sd)
+
+		score := sd.GetBestScore()
+		if sd.Pos.Side == engine.Black {
+			score = -score
+		}
+
+		// Only quiet positions are recorded, since the score of a position in the
+		// middle of an exchange says little about it, and mate scores are left out.
+		if !sd.Pos.IsSideInCheck(sd.Pos.Side) && !move.IsCapture() && !move.IsPromotion() &&
+			utils.Abs(score) < engine.LongestCheckmate {
+			game.positions = append(game.positions, SelfplayPosition{Pos: sd.Pos, Score: score})
+		}
+
+		switch {
+		case score >= config.ResignScore:
+			whiteWinPlies, blackWinPlies = whiteWinPlies+1, 0
+		case score <= -config.ResignScore:
+			whiteWinPlies, blackWinPlies = 0, blackWinPlies+1
+		default:
+			whiteWinPlies, blackWinPlies = 0, 0
+		}
+
+		if ply >= config.DrawMinPly && utils.Abs(score) <= config.DrawScore {
+			drawPlies++
+		} else {
+			drawPlies = 0
+		}
+
+		if config.ResignPlies > 0 && whiteWinPlies >= config.ResignPlies {
+			game.outcome = 1.0
+			return game
+		}
+
+		if config.ResignPlies > 0 && blackWinPlies >= config.ResignPlies {
+			game.outcome = 0.0
+			return game
+		}
+
+		if config.DrawPlies > 0 && drawPlies >= config.DrawPlies {
+			game.outcome = 0.5
+			return game
+		}
+
+		sd.Pos.DoMove(move)
+		sd.AddCurrPosToHistory()
+	}
+}
+
+// Play random moves from the starting position, so games don't all play out the same
+// way, trying again until the position reached is balanced enough and not over.
+func playRandomOpening(sd *engine.SearchData, config *SelfplayConfig) {
+	for {
+		sd.Pos.LoadFEN(engine.FENStartPosition)
+		sd.ClearPosHistory()
+		sd.AddCurrPosToHistory()
+
+		gameOver := false
+		for ply := 0; ply < config.RandomPlies; ply++ {
+			legalMoves := engine.GenLegalMoves(&sd.Pos)
+			if len(legalMoves) == 0 {
+				gameOver = true
+				break
+			}
+			sd.Pos.DoMove(legalMoves[rand.Intn(len(legalMoves))])
+			sd.AddCurrPosToHistory()
+		}
+
+		if gameOver || len(engine.GenLegalMoves(&sd.Pos)) == 0 {
+			continue
+		}
+
+		sd.Limits = engine.SearchLimits{}
+		sd.Timer.CalculateSearchTime(engine.InfiniteTimeFormat, 0, 0, 0, 0)
+		score := engine.Qsearch(sd, -engine.InfinityCPValue, engine.InfinityCPValue, 0)
+		if utils.Abs(score) <= config.OpeningMaxScore {
+			return
+		}
+	}
+}
+
+// Check for draws by the fifty move rule, threefold repetition, and insufficient
+// material.
+func gameIsDrawn(sd *engine.SearchData) bool {
+	pos := &sd.Pos
+	if pos.HalfMove >= 100 {
+		return true
+	}
+
+	repetitions := 0
+	history := sd.GetPosHistory()
+	for _, hash := range history[max(len(history)-int(pos.HalfMove)-1, 0):] {
+		if hash == pos.Hash {
+			repetitions++
+		}
+	}
+	if repetitions >= 3 {
+		return true
+	}
+
+	// Only a lone minor piece against a bare king can never mate.
+	if pos.Pieces[engine.Pawn]|pos.Pieces[engine.Rook]|pos.Pieces[engine.Queen] != 0 {
+		return false
+	}
+	minors := pos.Pieces[engine.Knight] | pos.Pieces[engine.Bishop]
+	return minors&(minors-1) == 0
+}
+
+func writeSelfplayPosition(writer io.Writer, position *SelfplayPosition, outcome float64, format string) {
+	var err error
+	if format == SelfplayFormatBinary {
+		packed := PackPosition(position, outcome)
+		_, err = writer.Write(packed[:])
+	} else {
+		// The castling rights and en passant square are kept, since the search score
+		// depends on them.
+		fields := strings.Fields(position.Pos.GenFEN())
+		_, err = fmt.Fprintf(
+			writer, "%s %s %s %s 0 1,%d,%.1f\n", fields[0], fields[1], fields[2], fields[3],
+			position.Score, outcome,
+		)
+	}
+
+	if err != nil {
+		panic(err)
+	}
+}
+
+// Pack a recorded position into the compact binary format, in little endian:
+//
+//	8 bytes:  the bitboard of occupied squares
+//	16 bytes: a nibble for each occupied square, from the lowest square up, holding
+//	          its piece type in the low three bits, and its color in the fourth
+//	2 bytes:  the search score, from white's perspective
+//	1 byte:   the outcome, from white's perspective: 0 for a loss, 1 for a draw,
+//	          2 for a win
+//	1 byte:   the side to move in the low four bits, and the castling rights in the
+//	          high four bits
+//
+// En passant squares aren't kept.
+func PackPosition(position *SelfplayPosition, outcome float64) (packed [PackedPositionSize]byte) {
+	pos := &position.Pos
+	occupied := pos.Colors[engine.White] | pos.Colors[engine.Black]
+	binary.LittleEndian.PutUint64(packed[0:8], occupied)
+
+	for i := 0; occupied != 0 && i < 32; i, occupied = i+1, occupied&(occupied-1) {
+		sq := engine.GetLSBpos(occupied)
+		nibble := pos.GetPieceTypeOnSq(sq) | pos.GetPieceColorOnSq(sq)<<3
+		packed[8+i/2] |= nibble << (4 * (i % 2))
+	}
+
+	binary.LittleEndian.PutUint16(packed[24:26], uint16(position.Score))
+	packed[26] = uint8(outcome * 2)
+	packed[27] = pos.Side | pos.Castling<<4
+	return packed
+}
+
+// Unpack a position written in the binary format, returning it along with the
+// outcome of its game.
+func UnpackPosition(packed []byte) (SelfplayPosition, float64) {
+	position := SelfplayPosition{}
+	pieces := [2][6][]uint8{}
+
+	occupied := binary.LittleEndian.Uint64(packed[0:8])
+	for i := 0; occupied != 0 && i < 32; i, occupied = i+1, occupied&(occupied-1) {
+		sq := engine.GetLSBpos(occupied)
+		nibble := packed[8+i/2] >> (4 * (i % 2)) & 0xf
+		pieceType, pieceColor := nibble&7, nibble>>3
+		pieces[pieceColor][pieceType] = append(pieces[pieceColor][pieceType], sq)
+	}
+
+	// Building a FEN keeps the position's hashes and incremental scores set up
+	// the same way as any other.
+	var board [64]byte
+	for color := range pieces {
+		for pieceType, squares := range pieces[color] {
+			char := "pnbrqk"[pieceType]
+			if color == engine.White {
+				char -= 'a' - 'A'
+			}
+			for _, sq := range squares {
+				board[sq] = char
+			}
+		}
+	}
+
+	var sb strings.Builder
+	for rank := 7; rank >= 0; rank-- {
+		empty := 0
+		for file := 0; file < 8; file++ {
+			if char := board[rank*8+file]; char != 0 {
+				if empty > 0 {
+					sb.WriteByte(byte('0' + empty))
+					empty = 0
+				}
+				sb.WriteByte(char)
+			} else {
+				empty++
+			}
+		}
+		if empty > 0 {
+			sb.WriteByte(byte('0' + empty))
+		}
+		if rank > 0 {
+			sb.WriteByte('/')
+		}
+	}
+
+	side := "w"
+	if packed[27]&0xf == engine.Black {
+		side = "b"
+	}
+
+	castling := ""
+	for i, char := range "KQkq" {
+		if packed[27]>>4&(engine.WhiteKingsideRight>>i) != 0 {
+			castling += string(char)
+		}
+	}
+	if castling == "" {
+		castling = "-"
+	}
+
+	position.Pos.LoadFEN(fmt.Sprintf("%s %s %s - 0 1", sb.String(), side, castling))
+	position.Score = int16(binary.LittleEndian.Uint16(packed[24:26]))
+	return position, float64(packed[26]) / 2
+}
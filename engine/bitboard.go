@@ -28,6 +28,10 @@ func GetLSBpos(bb uint64) uint8 {
 	return uint8(bits.TrailingZeros64(bb))
 }
 
+func CountBits(bb uint64) int16 {
+	return int16(bits.OnesCount64(bb))
+}
+
 func PrintBB(bb uint64) {
 	bitstring := fmt.Sprintf("%064b", bb)
 	for i := 7; i <= 63; i += 8 {
@@ -0,0 +1,390 @@
+package engine
+
+import (
+	"bufio"
+	"compress/flate"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Eques' own distance-to-mate tablebases, generated with "eques tbgen" for endgames of
+// up to DTMMaxPieces pieces. Unlike Syzygy tables, they give the exact number of plies
+// to mate, ignoring the fifty move rule, so the search can play endgames perfectly.
+//
+// A table stores a byte for every arrangement of its pieces and side to move, after
+// the board has been mirrored to put the white king in a canonical region: the
+// a1-d1-d4 triangle, or files a-d when there are pawns. A zero byte is a draw,
+// values 1-127 a win in that many plies, and values 128-255 a loss in that many
+// plies plus 128. Positions with an en passant square aren't stored, so endgames
+// with pawns of both colors, where en passant captures are possible, aren't supported.
+//
+// Files are named after the material of the table, e.g. KRvKP.eqtb, and hold:
+//   4 bytes: DTMMagic
+//   1 byte:  DTMFormatVersion
+//   1 byte:  length of the material key, followed by the key
+//   4 bytes: number of entries (little endian)
+//   the entries, compressed with DEFLATE
+
+const (
+	DTMMaxPieces     = 4
+	DTMFormatVersion = 1
+	DTMFileExtension = ".eqtb"
+
+	DTMMaxPlies = 127
+	dtmLossFlag = 128
+
+	// Distance to mate scores used while generating tables, from the perspective of
+	// the side to move: a win in n plies is DTMWinScore-n, and a loss in n plies
+	// -(DTMWinScore-n), so that better outcomes always have higher scores.
+	DTMWinScore int16 = 1000
+)
+
+var DTMMagic = [4]byte{'E', 'Q', 'T', 'B'}
+
+type dtmPiece struct {
+	pieceType uint8
+	color     uint8
+}
+
+type dtmTable struct {
+	key      string
+	path     string
+	pieces   []dtmPiece
+	hasPawns bool
+
+	loadOnce sync.Once
+	loaded   bool
+	entries  []uint8
+}
+
+var dtmTables = map[string]*dtmTable{}
+
+// The squares the white king is mirrored into, and the index of each of them,
+// indexed by whether the table has pawns.
+var dtmKingSquares [2][]uint8
+var dtmKingIndex [2][64]int
+
+func genDTMTables() {
+	for hasPawns := 0; hasPawns < 2; hasPawns++ {
+		dtmKingSquares[hasPawns] = nil
+		for sq := uint8(0); sq < 64; sq++ {
+			dtmKingIndex[hasPawns][sq] = -1
+
+			inRegion := FileOf(sq) <= FileD && RankOf(sq) <= FileOf(sq)
+			if hasPawns == 1 {
+				inRegion = FileOf(sq) <= FileD
+			}
+
+			if inRegion {
+				dtmKingIndex[hasPawns][sq] = len(dtmKingSquares[hasPawns])
+				dtmKingSquares[hasPawns] = append(dtmKingSquares[hasPawns], sq)
+			}
+		}
+	}
+}
+
+func newDTMTable(key string) *dtmTable {
+	table := &dtmTable{key: key}
+	for color, side := range strings.Split(key, "v") {
+		for _, char := range side {
+			pieceType := uint8(strings.IndexRune("PNBRQK", char))
+			table.pieces = append(table.pieces, dtmPiece{pieceType, uint8(color)})
+			if pieceType == Pawn {
+				table.hasPawns = true
+			}
+		}
+	}
+	return table
+}
+
+func (t *dtmTable) pawnIdx() int {
+	if t.hasPawns {
+		return 1
+	}
+	return 0
+}
+
+func (t *dtmTable) numEntries() int {
+	numEntries := 2 * len(dtmKingSquares[t.pawnIdx()])
+	for i := 1; i < len(t.pieces); i++ {
+		numEntries *= 64
+	}
+	return numEntries
+}
+
+// Compute the index of an arrangement of the table's pieces, whose white king
+// must already be in the canonical region.
+func (t *dtmTable) rawIndex(squares []uint8, side uint8) int {
+	idx := int(side)*len(dtmKingSquares[t.pawnIdx()]) + dtmKingIndex[t.pawnIdx()][squares[0]]
+	for _, sq := range squares[1:] {
+		idx = idx*64 + int(sq)
+	}
+	return idx
+}
+
+// Get the squares of the pieces, and side to move, stored at the given index.
+func (t *dtmTable) decodeIndex(idx int, squares []uint8) uint8 {
+	for i := len(t.pieces) - 1; i > 0; i-- {
+		squares[i] = uint8(idx % 64)
+		idx /= 64
+	}
+
+	numKingSquares := len(dtmKingSquares[t.pawnIdx()])
+	squares[0] = dtmKingSquares[t.pawnIdx()][idx%numKingSquares]
+	return uint8(idx / numKingSquares)
+}
+
+// Compute the index of an arrangement of the table's pieces. Each arrangement can be
+// mirrored into the canonical region in a few ways (and identical pieces swapped),
+// so the lowest of the possible indexes is used, which makes the index the same for
+// every arrangement which is a mirror image of another.
+func (t *dtmTable) index(squares []uint8, side uint8) int {
+	numTransforms := 8
+	if t.hasPawns {
+		numTransforms = 2
+	}
+
+	var transformed [DTMMaxPieces]uint8
+	bestIdx := -1
+
+	for transform := 0; transform < numTransforms; transform++ {
+		if dtmKingIndex[t.pawnIdx()][transformSq(squares[0], transform)] < 0 {
+			continue
+		}
+
+		for i, sq := range squares {
+			transformed[i] = transformSq(sq, transform)
+		}
+
+		// Sort the squares of identical pieces, so the order they're
+		// listed in doesn't matter.
+		for i := 1; i < len(squares); i++ {
+			for j := i; j > 0 && t.pieces[j] == t.pieces[j-1] && transformed[j] < transformed[j-1]; j-- {
+				transformed[j], transformed[j-1] = transformed[j-1], transformed[j]
+			}
+		}
+
+		idx := t.rawIndex(transformed[:len(squares)], side)
+		if bestIdx < 0 || idx < bestIdx {
+			bestIdx = idx
+		}
+	}
+
+	return bestIdx
+}
+
+// Get the squares of the position's pieces in the order of the table's pieces. If the
+// table stores the position with the colors swapped, the colors of the pieces are
+// swapped, and the board flipped vertically. Returns the side to move.
+func (t *dtmTable) positionSquares(pos *Position, swapColors bool, squares []uint8) uint8 {
+	colorFlip, sqFlip := uint8(0), uint8(0)
+	if swapColors {
+		colorFlip, sqFlip = 1, 56
+	}
+
+	for i := 0; i < len(t.pieces); {
+		piece := t.pieces[i]
+		pieces := pos.Pieces[piece.pieceType] & pos.Colors[piece.color^colorFlip]
+		for ; pieces != 0; pieces &= pieces - 1 {
+			squares[i] = GetLSBpos(pieces) ^ sqFlip
+			i++
+		}
+	}
+
+	return pos.Side ^ colorFlip
+}
+
+// Apply one of the eight symmetries of the board to the square: mirroring it
+// horizontally, vertically, and along the a1-h8 diagonal.
+func transformSq(sq uint8, transform int) uint8 {
+	if transform&1 != 0 {
+		sq ^= 7
+	}
+	if transform&2 != 0 {
+		sq ^= 56
+	}
+	if transform&4 != 0 {
+		sq = ((sq >> 3) | (sq << 3)) & 63
+	}
+	return sq
+}
+
+// Look for generated tablebase files in the given list of directories, separated
+// the same way as the PATH environment variable. Tables are only read into memory
+// the first time they're probed. Returns the number of tables found.
+func InitDTMTablebases(paths string) int {
+	dtmTables = map[string]*dtmTable{}
+
+	if paths == "" || paths == "<empty>" {
+		return 0
+	}
+
+	for _, dir := range filepath.SplitList(paths) {
+		files, err := os.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+
+		for _, file := range files {
+			key, isTable := strings.CutSuffix(file.Name(), DTMFileExtension)
+			if !isTable || !isValidTBCode(key) || len(key)-1 > DTMMaxPieces || dtmHasPawnsOfBothColors(key) {
+				continue
+			}
+			if _, ok := dtmTables[key]; !ok {
+				table := newDTMTable(key)
+				table.path = filepath.Join(dir, file.Name())
+				dtmTables[key] = table
+			}
+		}
+	}
+
+	return len(dtmTables)
+}
+
+func (t *dtmTable) load() bool {
+	t.loadOnce.Do(func() {
+		if t.entries != nil {
+			t.loaded = true
+			return
+		}
+
+		file, err := os.Open(t.path)
+		if err != nil {
+			return
+		}
+		defer file.Close()
+
+		reader := bufio.NewReader(file)
+		var header [6]byte
+		if _, err := io.ReadFull(reader, header[:]); err != nil {
+			return
+		}
+		if [4]byte(header[:4]) != DTMMagic || header[4] != DTMFormatVersion {
+			return
+		}
+
+		key := make([]byte, header[5])
+		if _, err := io.ReadFull(reader, key); err != nil || string(key) != t.key {
+			return
+		}
+
+		var numEntries uint32
+		if err := binary.Read(reader, binary.LittleEndian, &numEntries); err != nil {
+			return
+		}
+		if int(numEntries) != t.numEntries() {
+			return
+		}
+
+		entries := make([]uint8, numEntries)
+		if _, err := io.ReadFull(flate.NewReader(reader), entries); err != nil {
+			return
+		}
+
+		t.entries = entries
+		t.loaded = true
+	})
+	return t.loaded
+}
+
+func (t *dtmTable) write(path string) {
+	file, err := os.Create(path)
+	if err != nil {
+		panic(err)
+	}
+	defer file.Close()
+
+	writer := bufio.NewWriter(file)
+	writer.Write(DTMMagic[:])
+	writer.WriteByte(DTMFormatVersion)
+	writer.WriteByte(uint8(len(t.key)))
+	writer.WriteString(t.key)
+	binary.Write(writer, binary.LittleEndian, uint32(len(t.entries)))
+
+	compressor, err := flate.NewWriter(writer, flate.BestCompression)
+	if err != nil {
+		panic(err)
+	}
+
+	compressor.Write(t.entries)
+	compressor.Close()
+
+	if err := writer.Flush(); err != nil {
+		panic(err)
+	}
+}
+
+// Find the table holding the position's material, and whether the position has
+// to have its colors swapped to be found in the table.
+func findDTMTable(pos *Position) (*dtmTable, bool) {
+	key := tbMaterialKey(pos)
+	if table, ok := dtmTables[key]; ok {
+		return table, false
+	}
+	if table, ok := dtmTables[swapTBCode(key)]; ok {
+		return table, true
+	}
+	return nil, false
+}
+
+// Probe the generated tablebases for the distance to mate score of the position,
+// from the perspective of the side to move. The position shouldn't have castling
+// rights or an en passant square.
+func probeDTM(pos *Position) (int16, bool) {
+	if tbPieceCount(pos) == 2 {
+		return 0, true
+	}
+
+	table, swapColors := findDTMTable(pos)
+	if table == nil || !table.load() {
+		return 0, false
+	}
+
+	var squares [DTMMaxPieces]uint8
+	side := table.positionSquares(pos, swapColors, squares[:])
+	idx := table.index(squares[:len(table.pieces)], side)
+	return decodeDTMEntry(table.entries[idx]), true
+}
+
+func decodeDTMEntry(entry uint8) int16 {
+	switch {
+	case entry == 0:
+		return 0
+	case entry < dtmLossFlag:
+		return DTMWinScore - int16(entry)
+	}
+	return -(DTMWinScore - int16(entry-dtmLossFlag))
+}
+
+func encodeDTMScore(score int16) uint8 {
+	switch {
+	case score > 0:
+		return uint8(DTMWinScore - score)
+	case score < 0:
+		return uint8(DTMWinScore+score) + dtmLossFlag
+	}
+	return 0
+}
+
+// Convert a distance to mate score into a search score, relative to the root.
+func dtmSearchScore(score int16, ply uint8) int16 {
+	switch {
+	case score > 0:
+		return InfinityCPValue - int16(ply) - (DTMWinScore - score)
+	case score < 0:
+		return -InfinityCPValue + int16(ply) + (DTMWinScore + score)
+	}
+	return DrawCPValue
+}
+
+// Get the number of plies to the end of the game of a distance to mate score.
+func dtmPlies(score int16) int {
+	if score < 0 {
+		score = -score
+	}
+	return int(DTMWinScore - score)
+}
@@ -3,11 +3,22 @@ package engine
 const (
 	InfinityCPValue int16 = 10_000
 	DrawCPValue     int16 = 0
+
+	// The game phase is computed from the pieces left on the board, starting at
+	// TotalPhase in the opening, and reaching zero once only kings and pawns
+	// remain.
+	TotalPhase int16 = 24
+
+	// Indexes of the middlegame and endgame values of evaluation terms.
+	MG = 0
+	EG = 1
 )
 
-var PieceSquareTable = [6][64]int16{
+var PhaseValues = [6]int16{0, 1, 1, 2, 4, 0}
+
+var MGPieceSquareTable = [6][64]int16{
 	{
-		// Pawn PST
+		// Pawn MG PST
 		100, 100, 100, 100, 100, 100, 100, 100,
 		156, 141, 145, 140, 136, 134, 119, 128,
 		130, 128, 120, 129, 128, 114, 118, 126,
@@ -18,7 +29,7 @@ var PieceSquareTable = [6][64]int16{
 		100, 100, 100, 100, 100, 100, 100, 100,
 	},
 	{
-		// Knight PST
+		// Knight MG PST
 		280, 295, 293, 291, 290, 293, 297, 294,
 		272, 292, 291, 308, 291, 297, 286, 283,
 		287, 302, 322, 329, 309, 307, 296, 282,
@@ -29,7 +40,7 @@ var PieceSquareTable = [6][64]int16{
 		276, 275, 275, 274, 273, 279, 270, 275,
 	},
 	{
-		// Bishop PST
+		// Bishop MG PST
 		299, 306, 299, 299, 297, 301, 297, 299,
 		302, 317, 304, 300, 307, 302, 298, 286,
 		313, 310, 314, 326, 315, 321, 309, 321,
@@ -40,7 +51,7 @@ var PieceSquareTable = [6][64]int16{
 		287, 287, 298, 292, 296, 291, 298, 290,
 	},
 	{
-		// Rook PST
+		// Rook MG PST
 		513, 513, 508, 511, 501, 503, 499, 498,
 		509, 514, 516, 520, 512, 511, 499, 503,
 		508, 511, 515, 516, 508, 504, 497, 493,
@@ -51,7 +62,7 @@ var PieceSquareTable = [6][64]int16{
 		481, 489, 493, 494, 490, 492, 477, 474,
 	},
 	{
-		// Queen PST
+		// Queen MG PST
 		856, 851, 847, 849, 855, 854, 852, 851,
 		835, 837, 860, 857, 853, 861, 848, 852,
 		860, 849, 852, 862, 871, 871, 867, 861,
@@ -62,7 +73,7 @@ var PieceSquareTable = [6][64]int16{
 		846, 847, 845, 854, 848, 839, 843, 848,
 	},
 	{
-		// King PST
+		// King MG PST
 		  1,   0,   0,   1,   2,   1,  -1,   0,
 		  2,   6,   6,   4,   1,   7,  12,  -1,
 		  4,  18,  18,  13,  11,  14,  17,   0,
@@ -74,6 +85,75 @@ var PieceSquareTable = [6][64]int16{
 	},
 }
 
+var EGPieceSquareTable = [6][64]int16{
+	{
+		// Pawn EG PST
+		100, 100, 100, 100, 100, 100, 100, 100,
+		185, 185, 185, 185, 185, 185, 185, 185,
+		150, 150, 150, 150, 150, 150, 150, 150,
+		120, 120, 120, 120, 120, 120, 120, 120,
+		108, 108, 108, 108, 108, 108, 108, 108,
+		102, 102, 102, 102, 102, 102, 102, 102,
+		100, 100, 100, 100, 100, 100, 100, 100,
+		100, 100, 100, 100, 100, 100, 100, 100,
+	},
+	{
+		// Knight EG PST
+		245, 260, 265, 265, 265, 265, 260, 245,
+		260, 275, 285, 285, 285, 285, 275, 260,
+		265, 285, 295, 300, 300, 295, 285, 265,
+		265, 285, 300, 305, 305, 300, 285, 265,
+		265, 285, 300, 305, 305, 300, 285, 265,
+		265, 285, 295, 300, 300, 295, 285, 265,
+		260, 275, 285, 285, 285, 285, 275, 260,
+		245, 260, 265, 265, 265, 265, 260, 245,
+	},
+	{
+		// Bishop EG PST
+		285, 295, 295, 295, 295, 295, 295, 285,
+		295, 305, 305, 305, 305, 305, 305, 295,
+		295, 305, 310, 312, 312, 310, 305, 295,
+		295, 305, 312, 318, 318, 312, 305, 295,
+		295, 305, 312, 318, 318, 312, 305, 295,
+		295, 305, 310, 312, 312, 310, 305, 295,
+		295, 305, 305, 305, 305, 305, 305, 295,
+		285, 295, 295, 295, 295, 295, 295, 285,
+	},
+	{
+		// Rook EG PST
+		505, 505, 505, 505, 505, 505, 505, 505,
+		515, 515, 515, 515, 515, 515, 515, 515,
+		500, 500, 500, 500, 500, 500, 500, 500,
+		500, 500, 500, 500, 500, 500, 500, 500,
+		500, 500, 500, 500, 500, 500, 500, 500,
+		500, 500, 500, 500, 500, 500, 500, 500,
+		500, 500, 500, 500, 500, 500, 500, 500,
+		497, 497, 497, 497, 497, 497, 497, 497,
+	},
+	{
+		// Queen EG PST
+		840, 850, 850, 855, 855, 850, 850, 840,
+		850, 860, 865, 865, 865, 865, 860, 850,
+		850, 865, 870, 875, 875, 870, 865, 850,
+		855, 865, 875, 880, 880, 875, 865, 855,
+		855, 865, 875, 880, 880, 875, 865, 855,
+		850, 865, 870, 875, 875, 870, 865, 850,
+		850, 860, 865, 865, 865, 865, 860, 850,
+		840, 850, 850, 855, 855, 850, 850, 840,
+	},
+	{
+		// King EG PST
+		-50, -30, -30, -30, -30, -30, -30, -50,
+		-30, -10,   0,   5,   5,   0, -10, -30,
+		-30,   0,  15,  20,  20,  15,   0, -30,
+		-30,   5,  20,  30,  30,  20,   5, -30,
+		-30,   5,  20,  30,  30,  20,   5, -30,
+		-30,   0,  15,  20,  20,  15,   0, -30,
+		-30, -10,   0,   5,   5,   0, -10, -30,
+		-50, -30, -30, -30, -30, -30, -30, -50,
+	},
+}
+
 var FlipSq = [2][64]uint8{
 	{
 		A8, B8, C8, D8, E8, F8, G8, H8,
@@ -98,5 +178,28 @@ var FlipSq = [2][64]uint8{
 }
 
 func EvaluatePosition(pos *Position) int16 {
-	return pos.Scores[pos.Side] - pos.Scores[pos.Side^1]
+	return evaluate(pos, nil, nil)
+}
+
+// Evaluate the position from the perspective of the side to move, using the given
+// pawn table to cache pawn structure evaluations, if it isn't nil. If a trace is
+// given, the contribution of each evaluation term is also recorded in it. The network
+// is used instead when one is loaded, unless the evaluation is being traced.
+func evaluate(pos *Position, pawnTable *TranspositionTable[PawnEntry], trace *EvalTrace) int16 {
+	if activeNetwork != nil && trace == nil {
+		return activeNetwork.evaluate(pos)
+	}
+
+	mgScores := pos.MGScores
+	egScores := pos.EGScores
+
+	evaluatePawns(pos, pawnTable, &mgScores, &egScores, trace)
+	evaluatePieces(pos, &mgScores, &egScores, trace)
+
+	mgScore := int32(mgScores[pos.Side] - mgScores[pos.Side^1])
+	egScore := int32(egScores[pos.Side] - egScores[pos.Side^1])
+
+	// Promotions can push the phase past its starting value, so clamp it.
+	phase := int32(min(pos.Phase, TotalPhase))
+	return int16((mgScore*phase + egScore*(int32(TotalPhase)-phase)) / int32(TotalPhase))
 }
@@ -0,0 +1,14 @@
+//go:build !unix && !windows
+
+package engine
+
+import "os"
+
+// Memory mapping isn't available, so read the whole file instead.
+func mapFile(path string) ([]byte, error) {
+	return os.ReadFile(path)
+}
+
+func unmapFile(data []byte) error {
+	return nil
+}
@@ -0,0 +1,53 @@
+package engine
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// Map the file into memory read-only, so its pages are only read from disk when
+// they're first touched, and can be dropped again by the OS under memory pressure.
+func mapFile(path string) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := info.Size()
+	if size == 0 {
+		return nil, errors.New("can't map an empty file")
+	}
+
+	mapping, err := syscall.CreateFileMapping(syscall.Handle(file.Fd()), nil, syscall.PAGE_READONLY, uint32(size>>32), uint32(size), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer syscall.CloseHandle(mapping)
+
+	addr, err := syscall.MapViewOfFile(mapping, syscall.FILE_MAP_READ, 0, 0, uintptr(size))
+	if err != nil {
+		return nil, err
+	}
+
+	// The view lives outside of Go's heap, so the slice is pointed at it directly.
+	var data []byte
+	header := (*struct {
+		data     uintptr
+		len, cap int
+	})(unsafe.Pointer(&data))
+	header.data = addr
+	header.len = int(size)
+	header.cap = int(size)
+	return data, nil
+}
+
+func unmapFile(data []byte) error {
+	return syscall.UnmapViewOfFile(uintptr(unsafe.Pointer(unsafe.SliceData(data))))
+}
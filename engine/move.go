@@ -71,6 +71,17 @@ func (move *Move) SetScore(score uint16) {
 	*move |= (Move(score) << 19)
 }
 
+func (move Move) IsCapture() bool {
+	moveType := move.Type()
+	return moveType == Attack || moveType == WhiteAttackEP || moveType == BlackAttackEP ||
+		(moveType >= PromoAttkQ && moveType <= PromoAttkN)
+}
+
+func (move Move) IsPromotion() bool {
+	moveType := move.Type()
+	return moveType >= PromoQ && moveType <= PromoAttkN
+}
+
 func (move Move) Equal(other Move) bool {
 	return (move & FlippedMoveScoreBitmask) == (other & FlippedMoveScoreBitmask)
 }
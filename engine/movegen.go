@@ -43,6 +43,21 @@ func genMoves(pos *Position) (moves []Move) {
 	return moves
 }
 
+// Generate only the legal moves of the position, for code outside of the search,
+// which doesn't need to squeeze out the speed of checking legality lazily.
+func GenLegalMoves(pos *Position) []Move {
+	legalMoves := make([]Move, 0, StartingMoveListSize)
+	child := Position{}
+	for _, move := range genMoves(pos) {
+		CopyPos(pos, &child)
+		child.DoMove(move)
+		if !child.IsSideInCheck(pos.Side) {
+			legalMoves = append(legalMoves, move)
+		}
+	}
+	return legalMoves
+}
+
 func genAttacksAndQueenPromos(pos *Position) (moves []Move) {
 	moves = make([]Move, 0, StartingMoveListSize)
 	usBB := pos.Colors[pos.Side]
@@ -0,0 +1,196 @@
+package engine
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+)
+
+// An efficiently updatable neural network (NNUE) evaluation. The network has 768
+// inputs, one for each combination of piece type, color, and square, seen from the
+// perspective of each side, feeding a hidden layer of NNUEHiddenSize neurons shared by
+// both perspectives. The hidden layer of the side to move and of the other side are
+// then concatenated, passed through a clipped ReLU, and into a single output neuron:
+//
+//	768 -> NNUEHiddenSize (x2) -> 1
+//
+// Since only a couple of inputs change with each move, the hidden layer, called the
+// accumulator, is kept up to date in putPiece and removePiece instead of being
+// recomputed for every evaluation. All arithmetic is done on integers: the feature
+// weights and biases are quantized by NNUEQA, and the output weights by NNUEQB.
+//
+// Network files hold, in little endian:
+//   4 bytes: NNUEMagic
+//   1 byte:  NNUEFormatVersion
+//   2 bytes: the size of the hidden layer, which must be NNUEHiddenSize
+//   int16 feature weights, NNUEInputSize rows of NNUEHiddenSize
+//   int16 feature biases, NNUEHiddenSize of them
+//   int16 output weights, the side to move's NNUEHiddenSize, then the other side's
+//   int32 output bias, quantized by NNUEQA*NNUEQB
+
+const (
+	NNUEInputSize     = 768
+	NNUEHiddenSize    = 256
+	NNUEFormatVersion = 1
+
+	NNUEQA    = 255
+	NNUEQB    = 64
+	NNUEScale = 400
+)
+
+var NNUEMagic = [4]byte{'E', 'Q', 'N', 'N'}
+
+type NNUENetwork struct {
+	FeatureWeights [NNUEInputSize][NNUEHiddenSize]int16
+	FeatureBiases  [NNUEHiddenSize]int16
+	OutputWeights  [2][NNUEHiddenSize]int16
+	OutputBias     int32
+}
+
+// The sum of the feature weights of every piece on the board, from the perspective
+// of each color. The biases are only added when evaluating, so the accumulator of an
+// empty board is all zeros.
+type Accumulator [2][NNUEHiddenSize]int16
+
+// The network used to evaluate positions, or nil to use the hand-crafted evaluation.
+var activeNetwork *NNUENetwork
+
+// Get the index of the input of a piece, from the perspective of the given color.
+// Inputs are ordered by whether the piece belongs to that color, then the piece
+// type, then the square, flipped vertically for black.
+func NNUEFeatureIndex(perspective, pieceType, pieceColor, sq uint8) int {
+	side := 0
+	if pieceColor != perspective {
+		side = 1
+	}
+	if perspective == Black {
+		sq ^= 56
+	}
+	return side*384 + int(pieceType)*64 + int(sq)
+}
+
+// Load the network from the given file and use it to evaluate positions from now on.
+// An empty path switches back to the hand-crafted evaluation, as does a file which
+// can't be loaded, in which case the error is returned.
+func InitNNUE(path string) error {
+	activeNetwork = nil
+	if path == "" || path == "<empty>" {
+		return nil
+	}
+
+	net, err := LoadNNUENetwork(path)
+	if err != nil {
+		return err
+	}
+
+	activeNetwork = net
+	return nil
+}
+
+func NNUEEnabled() bool {
+	return activeNetwork != nil
+}
+
+func LoadNNUENetwork(path string) (*NNUENetwork, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	var header [7]byte
+	if _, err := io.ReadFull(reader, header[:]); err != nil {
+		return nil, err
+	}
+	if [4]byte(header[:4]) != NNUEMagic {
+		return nil, fmt.Errorf("%s is not a network file", path)
+	}
+	if header[4] != NNUEFormatVersion {
+		return nil, fmt.Errorf("%s has format version %d, expected %d", path, header[4], NNUEFormatVersion)
+	}
+	if hiddenSize := binary.LittleEndian.Uint16(header[5:]); hiddenSize != NNUEHiddenSize {
+		return nil, fmt.Errorf("%s has a hidden layer of %d neurons, expected %d", path, hiddenSize, NNUEHiddenSize)
+	}
+
+	net := &NNUENetwork{}
+	if err := binary.Read(reader, binary.LittleEndian, net); err != nil {
+		return nil, err
+	}
+	return net, nil
+}
+
+func (net *NNUENetwork) Save(path string) {
+	file, err := os.Create(path)
+	if err != nil {
+		panic(err)
+	}
+	defer file.Close()
+
+	writer := bufio.NewWriter(file)
+	writer.Write(NNUEMagic[:])
+	writer.WriteByte(NNUEFormatVersion)
+	binary.Write(writer, binary.LittleEndian, uint16(NNUEHiddenSize))
+	binary.Write(writer, binary.LittleEndian, net)
+
+	if err := writer.Flush(); err != nil {
+		panic(err)
+	}
+}
+
+func (acc *Accumulator) addPiece(net *NNUENetwork, pieceType, pieceColor, sq uint8) {
+	whiteWeights := &net.FeatureWeights[NNUEFeatureIndex(White, pieceType, pieceColor, sq)]
+	blackWeights := &net.FeatureWeights[NNUEFeatureIndex(Black, pieceType, pieceColor, sq)]
+	for i := 0; i < NNUEHiddenSize; i++ {
+		acc[White][i] += whiteWeights[i]
+		acc[Black][i] += blackWeights[i]
+	}
+}
+
+func (acc *Accumulator) removePiece(net *NNUENetwork, pieceType, pieceColor, sq uint8) {
+	whiteWeights := &net.FeatureWeights[NNUEFeatureIndex(White, pieceType, pieceColor, sq)]
+	blackWeights := &net.FeatureWeights[NNUEFeatureIndex(Black, pieceType, pieceColor, sq)]
+	for i := 0; i < NNUEHiddenSize; i++ {
+		acc[White][i] -= whiteWeights[i]
+		acc[Black][i] -= blackWeights[i]
+	}
+}
+
+// Recompute the accumulator from scratch. Needed when the network changes after the
+// position has been set up.
+func (pos *Position) refreshAccumulator() {
+	pos.Accumulator = Accumulator{}
+	if activeNetwork == nil {
+		return
+	}
+
+	for piecesBB := pos.Colors[White] | pos.Colors[Black]; piecesBB != 0; piecesBB &= piecesBB - 1 {
+		sq := GetLSBpos(piecesBB)
+		pos.Accumulator.addPiece(activeNetwork, pos.GetPieceTypeOnSq(sq), pos.GetPieceColorOnSq(sq), sq)
+	}
+}
+
+// Evaluate the position from the perspective of the side to move, with its
+// accumulator, which must be up to date.
+func (net *NNUENetwork) evaluate(pos *Position) int16 {
+	us := &pos.Accumulator[pos.Side]
+	them := &pos.Accumulator[pos.Side^1]
+
+	output := int64(0)
+	for i := 0; i < NNUEHiddenSize; i++ {
+		output += clippedReLU(us[i]+net.FeatureBiases[i]) * int64(net.OutputWeights[0][i])
+		output += clippedReLU(them[i]+net.FeatureBiases[i]) * int64(net.OutputWeights[1][i])
+	}
+
+	score := (output + int64(net.OutputBias)) * NNUEScale / (NNUEQA * NNUEQB)
+
+	// Keep the score well away from mate scores.
+	bound := int64(LongestCheckmate - MaxPly - 1)
+	return int16(max(min(score, bound), -bound))
+}
+
+func clippedReLU(value int16) int64 {
+	return int64(max(min(value, NNUEQA), 0))
+}
@@ -0,0 +1,188 @@
+package engine
+
+const (
+	PawnEntrySize = 24
+	PawnTableSize = 2
+)
+
+var DoubledPawnPenalty = [2]int16{10, 20}
+var IsolatedPawnPenalty = [2]int16{10, 15}
+var BackwardPawnPenalty = [2]int16{8, 10}
+var ConnectedPawnBonus = [2]int16{7, 5}
+
+// Passed pawn bonuses, indexed by phase and then the rank of the pawn relative
+// to its side.
+var PassedPawnBonus = [2][8]int16{
+	{0, 5, 10, 15, 30, 50, 80, 0},
+	{0, 10, 20, 35, 60, 100, 150, 0},
+}
+
+// Bonuses for passed pawns are divided by this value when there's a
+// piece standing on the path to the pawn's promotion square.
+const BlockedPassedPawnDivisor int16 = 2
+
+// A pawn entry caches the evaluation of a pawn structure, which only changes
+// when a pawn moves or is captured. Passed pawns are cached as a bitboard rather
+// than being scored, since whether they're blocked depends on the other pieces.
+type PawnEntry struct {
+	hash        uint64
+	passedPawns uint64
+	mgScores    [2]int16
+	egScores    [2]int16
+}
+
+func (entry PawnEntry) Hash() uint64 {
+	return entry.hash
+}
+
+func (entry PawnEntry) Depth() uint8 {
+	return 0
+}
+
+func (entry PawnEntry) Age() uint8 {
+	return 0
+}
+
+// Evaluate the pawn structure of the position, adding each side's score to the given
+// middlegame and endgame scores. If a pawn table is given, the evaluation of the
+// structure is taken from it when possible, and stored in it otherwise. The table
+// isn't used when tracing, since the trace needs the structure evaluated.
+func evaluatePawns(pos *Position, pawnTable *TranspositionTable[PawnEntry], mgScores, egScores *[2]int16, trace *EvalTrace) {
+	var entry PawnEntry
+	cached := false
+
+	if pawnTable != nil && pawnTable.size > 0 && trace == nil {
+		if entryPtr := pawnTable.Probe(pos.PawnHash); entryPtr != nil {
+			entry = *entryPtr
+			cached = true
+		}
+	}
+
+	if !cached {
+		entry.hash = pos.PawnHash
+		evaluatePawnStructure(pos, White, &entry, trace)
+		evaluatePawnStructure(pos, Black, &entry, trace)
+
+		if pawnTable != nil && pawnTable.size > 0 {
+			*pawnTable.Store(pos.PawnHash, 0) = entry
+		}
+	}
+
+	allBB := pos.Colors[White] | pos.Colors[Black]
+	for color := uint8(White); color <= Black; color++ {
+		mgScores[color] += entry.mgScores[color]
+		egScores[color] += entry.egScores[color]
+		trace.add(PawnStructureTerm, color, entry.mgScores[color], entry.egScores[color])
+
+		// Passed pawn bonuses are summed at BlockedPassedPawnDivisor times their value,
+		// and only divided once every pawn's been counted, so the bonus of a blocked
+		// pawn is divided the same way its traced coefficient is, rather than being
+		// rounded down pawn by pawn.
+		mgPassed, egPassed := int16(0), int16(0)
+		passedPawns := entry.passedPawns & pos.Colors[color]
+		for passedPawns != 0 {
+			sq := GetLSBpos(passedPawns)
+			passedPawns &= passedPawns - 1
+
+			rank := relativeRank(sq, color)
+			weight := BlockedPassedPawnDivisor
+			if ForwardFileMasks[color][sq]&allBB != 0 {
+				weight = 1
+			}
+
+			if trace != nil {
+				trace.Coefficients.PassedPawns[color][rank] += float64(weight) / float64(BlockedPassedPawnDivisor)
+			}
+
+			mgPassed += PassedPawnBonus[MG][rank] * weight
+			egPassed += PassedPawnBonus[EG][rank] * weight
+		}
+
+		mgBonus := mgPassed / BlockedPassedPawnDivisor
+		egBonus := egPassed / BlockedPassedPawnDivisor
+		mgScores[color] += mgBonus
+		egScores[color] += egBonus
+		trace.add(PassedPawnsTerm, color, mgBonus, egBonus)
+	}
+}
+
+func evaluatePawnStructure(pos *Position, color uint8, entry *PawnEntry, trace *EvalTrace) {
+	usPawns := pos.Pieces[Pawn] & pos.Colors[color]
+	enemyPawns := pos.Pieces[Pawn] & pos.Colors[color^1]
+
+	pawns := usPawns
+	for pawns != 0 {
+		sq := GetLSBpos(pawns)
+		pawns &= pawns - 1
+
+		isolated := IsolatedPawnMasks[FileOf(sq)]&usPawns == 0
+		doubled := ForwardFileMasks[color][sq]&usPawns != 0
+
+		// A pawn is connected if it's defended by another pawn, or has
+		// another pawn beside it.
+		supported := PawnAttacks[color^1][sq]&usPawns != 0
+		phalanx := IsolatedPawnMasks[FileOf(sq)]&MaskRank[RankOf(sq)]&usPawns != 0
+
+		backward := !isolated && isBackwardPawn(sq, color, usPawns, enemyPawns)
+		connected := supported || phalanx
+
+		if doubled {
+			entry.mgScores[color] -= DoubledPawnPenalty[MG]
+			entry.egScores[color] -= DoubledPawnPenalty[EG]
+		}
+
+		if isolated {
+			entry.mgScores[color] -= IsolatedPawnPenalty[MG]
+			entry.egScores[color] -= IsolatedPawnPenalty[EG]
+		} else if backward {
+			entry.mgScores[color] -= BackwardPawnPenalty[MG]
+			entry.egScores[color] -= BackwardPawnPenalty[EG]
+		}
+
+		if connected {
+			entry.mgScores[color] += ConnectedPawnBonus[MG]
+			entry.egScores[color] += ConnectedPawnBonus[EG]
+		}
+
+		if trace != nil {
+			trace.Coefficients.DoubledPawns[color] -= boolToFloat(doubled)
+			trace.Coefficients.IsolatedPawns[color] -= boolToFloat(isolated)
+			trace.Coefficients.BackwardPawns[color] -= boolToFloat(backward)
+			trace.Coefficients.ConnectedPawns[color] += boolToFloat(connected)
+		}
+
+		// Only the front-most pawn of doubled pawns is counted as passed.
+		if !doubled && PassedPawnMasks[color][sq]&enemyPawns == 0 {
+			entry.passedPawns = SetBit(entry.passedPawns, sq)
+		}
+	}
+}
+
+// A pawn is backward if no pawn on an adjacent file can ever defend it, and it
+// can't safely advance since its stop square is attacked by an enemy pawn.
+func isBackwardPawn(sq, color uint8, usPawns, enemyPawns uint64) bool {
+	if PawnSupportMasks[color][sq]&usPawns != 0 {
+		return false
+	}
+
+	stopSq := sq + 8
+	if color == Black {
+		stopSq = sq - 8
+	}
+
+	return PawnAttacks[color][stopSq]&enemyPawns != 0
+}
+
+func boolToFloat(value bool) float64 {
+	if value {
+		return 1
+	}
+	return 0
+}
+
+func relativeRank(sq, color uint8) uint8 {
+	if color == White {
+		return RankOf(sq)
+	}
+	return Rank8 - RankOf(sq)
+}
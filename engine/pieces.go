@@ -0,0 +1,132 @@
+package engine
+
+// Mobility bonuses for each safe square a piece can move to, indexed by phase
+// and then piece type. A square is safe if it's not occupied by a friendly piece
+// and isn't attacked by an enemy pawn.
+var MobilityBonus = [2][6]int16{
+	{0, 4, 3, 2, 1, 0},
+	{0, 4, 3, 4, 2, 0},
+}
+
+// Penalties for each square in the king zone attacked by an enemy piece, indexed by
+// phase and then the type of the attacking piece. They're only applied once at least
+// MinKingAttackers pieces are attacking the zone, since a lone attacker is rarely
+// dangerous on its own.
+var KingAttackWeights = [2][6]int16{
+	{0, 6, 4, 6, 10, 0},
+	{0, 1, 1, 1, 2, 0},
+}
+
+const MinKingAttackers = 2
+
+// Bonuses for each pawn sheltering the king, indexed by phase and then whether the
+// pawn is one or two ranks in front of the king.
+var PawnShieldBonus = [2][2]int16{
+	{12, 6},
+	{2, 1},
+}
+
+// Evaluate the mobility of each side's pieces and the safety of their kings, adding
+// each side's score to the given middlegame and endgame scores.
+func evaluatePieces(pos *Position, mgScores, egScores *[2]int16, trace *EvalTrace) {
+	allBB := pos.Colors[White] | pos.Colors[Black]
+	pawnAttacks := [2]uint64{
+		pawnAttacksBB(pos.Pieces[Pawn]&pos.Colors[White], White),
+		pawnAttacksBB(pos.Pieces[Pawn]&pos.Colors[Black], Black),
+	}
+
+	for color := uint8(White); color <= Black; color++ {
+		enemyKingSq := GetLSBpos(pos.Pieces[King] & pos.Colors[color^1])
+		kingZone := SetBit(KingMoves[enemyKingSq], enemyKingSq)
+		safeSquares := ^pos.Colors[color] & ^pawnAttacks[color^1]
+
+		var attackers int16
+		var kingAttacks [2]int16
+		var zoneAttackCounts [6]int16
+
+		for pieceType := uint8(Knight); pieceType <= Queen; pieceType++ {
+			pieces := pos.Pieces[pieceType] & pos.Colors[color]
+			for pieces != 0 {
+				sq := GetLSBpos(pieces)
+				pieces &= pieces - 1
+
+				attacks := pieceAttacks(pieceType, sq, allBB)
+				mobility := CountBits(attacks & safeSquares)
+				mgScores[color] += mobility * MobilityBonus[MG][pieceType]
+				egScores[color] += mobility * MobilityBonus[EG][pieceType]
+				trace.add(MobilityTerm, color, mobility*MobilityBonus[MG][pieceType], mobility*MobilityBonus[EG][pieceType])
+				if trace != nil {
+					trace.Coefficients.Mobility[color][pieceType] += float64(mobility)
+				}
+
+				if zoneAttacks := CountBits(attacks & kingZone); zoneAttacks > 0 {
+					attackers++
+					kingAttacks[MG] += zoneAttacks * KingAttackWeights[MG][pieceType]
+					kingAttacks[EG] += zoneAttacks * KingAttackWeights[EG][pieceType]
+					zoneAttackCounts[pieceType] += zoneAttacks
+				}
+			}
+		}
+
+		if attackers >= MinKingAttackers {
+			mgScores[color^1] -= kingAttacks[MG]
+			egScores[color^1] -= kingAttacks[EG]
+			trace.add(KingAttacksTerm, color^1, -kingAttacks[MG], -kingAttacks[EG])
+			if trace != nil {
+				for pieceType, count := range zoneAttackCounts {
+					trace.Coefficients.KingAttacks[color^1][pieceType] -= float64(count)
+				}
+			}
+		}
+
+		evaluatePawnShield(pos, color, mgScores, egScores, trace)
+	}
+}
+
+// Score the pawns standing on the king's file and the files beside it, on the two
+// ranks directly in front of the king.
+func evaluatePawnShield(pos *Position, color uint8, mgScores, egScores *[2]int16, trace *EvalTrace) {
+	kingSq := GetLSBpos(pos.Pieces[King] & pos.Colors[color])
+	usPawns := pos.Pieces[Pawn] & pos.Colors[color]
+	shieldFiles := MaskFile[FileOf(kingSq)] | IsolatedPawnMasks[FileOf(kingSq)]
+
+	for distance := uint8(0); distance < 2; distance++ {
+		rank := relativeRank(kingSq, color) + distance + 1
+		if rank > Rank8 {
+			break
+		}
+		if color == Black {
+			rank = Rank8 - rank
+		}
+
+		shieldPawns := CountBits(usPawns & shieldFiles & MaskRank[rank])
+		mgScores[color] += shieldPawns * PawnShieldBonus[MG][distance]
+		egScores[color] += shieldPawns * PawnShieldBonus[EG][distance]
+		trace.add(PawnShieldTerm, color, shieldPawns*PawnShieldBonus[MG][distance], shieldPawns*PawnShieldBonus[EG][distance])
+		if trace != nil {
+			trace.Coefficients.PawnShield[color][distance] += float64(shieldPawns)
+		}
+	}
+}
+
+func pieceAttacks(pieceType, sq uint8, allBB uint64) uint64 {
+	switch pieceType {
+	case Knight:
+		return KnightMoves[sq]
+	case Bishop:
+		return LookupBishopMoves(sq, allBB)
+	case Rook:
+		return LookupRookMoves(sq, allBB)
+	case Queen:
+		return LookupBishopMoves(sq, allBB) | LookupRookMoves(sq, allBB)
+	}
+	return 0
+}
+
+// Get a bitboard of all the squares attacked by the given pawns.
+func pawnAttacksBB(pawns uint64, color uint8) uint64 {
+	if color == White {
+		return (pawns&ClearFile[FileA])<<7 | (pawns&ClearFile[FileH])<<9
+	}
+	return (pawns&ClearFile[FileA])>>9 | (pawns&ClearFile[FileH])>>7
+}
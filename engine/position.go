@@ -45,7 +45,14 @@ type Position struct {
 	Pieces   [6]uint64
 	Colors   [2]uint64
 	Hash     uint64
-	Scores   [2]int16
+	PawnHash uint64
+	MGScores [2]int16
+	EGScores [2]int16
+	Phase    int16
+
+	// Only kept up to date while a network is being used to evaluate positions.
+	Accumulator Accumulator
+
 	Side,
 	Castling,
 	EPSq,
@@ -62,7 +69,13 @@ func CopyPos(oldPos, newPos *Position) {
 	newPos.Pieces = oldPos.Pieces
 	newPos.Colors = oldPos.Colors
 	newPos.Hash = oldPos.Hash
-	newPos.Scores = oldPos.Scores
+	newPos.PawnHash = oldPos.PawnHash
+	newPos.MGScores = oldPos.MGScores
+	newPos.EGScores = oldPos.EGScores
+	newPos.Phase = oldPos.Phase
+	if activeNetwork != nil {
+		newPos.Accumulator = oldPos.Accumulator
+	}
 	newPos.Side = oldPos.Side
 	newPos.Castling = oldPos.Castling
 	newPos.EPSq = oldPos.EPSq
@@ -72,7 +85,10 @@ func CopyPos(oldPos, newPos *Position) {
 func (pos *Position) LoadFEN(fen string) {
 	pos.Pieces = [6]uint64{}
 	pos.Colors = [2]uint64{}
-	pos.Scores = [2]int16{}
+	pos.MGScores = [2]int16{}
+	pos.EGScores = [2]int16{}
+	pos.Phase = 0
+	pos.Accumulator = Accumulator{}
 
 	fields := strings.Fields(fen)
 	pieces := fields[0]
@@ -131,6 +147,7 @@ func (pos *Position) LoadFEN(fen string) {
 	}
 
 	pos.Hash = GenHash(pos)
+	pos.PawnHash = GenPawnHash(pos)
 }
 
 func (pos Position) String() (boardStr string) {
@@ -253,6 +270,10 @@ func (pos *Position) IsSideInCheck(side uint8) bool {
 	return pos.SqIsAttacked(side, GetLSBpos(pos.Pieces[King] & pos.Colors[side]))
 }
 
+func (pos *Position) hasNonPawnMaterial(side uint8) bool {
+	return pos.Colors[side] & ^(pos.Pieces[Pawn]|pos.Pieces[King]) != 0
+}
+
 func (pos *Position) SqIsAttacked(usColor, sq uint8) bool {
 	enemyBB := pos.Colors[usColor^1]
 	usBB := pos.Colors[usColor]
@@ -338,6 +359,20 @@ func (pos *Position) DoMove(move Move) {
 	pos.Hash ^= SideZobristValues[pos.Side]
 }
 
+// Pass the turn to the other side without moving a piece. Used by null move pruning,
+// so the move is undone the same way as a normal move, by restoring a copy of the
+// position.
+func (pos *Position) DoNullMove() {
+	pos.Hash ^= EPSqZobristValues[pos.EPSq]
+	pos.Hash ^= SideZobristValues[pos.Side]
+
+	pos.EPSq = NoSq
+	pos.Side ^= 1
+
+	pos.Hash ^= EPSqZobristValues[pos.EPSq]
+	pos.Hash ^= SideZobristValues[pos.Side]
+}
+
 func (pos *Position) doEPAttack(toSq, capturedPawnSq uint8) {
 	pos.removePiece(Pawn, pos.Side^1, capturedPawnSq)
 	pos.putPiece(Pawn, pos.Side, toSq)
@@ -362,14 +397,30 @@ func (pos *Position) putPiece(pieceType, pieceColor, sq uint8) {
 	pos.Pieces[pieceType] = SetBit(pos.Pieces[pieceType], sq)
 	pos.Colors[pieceColor] = SetBit(pos.Colors[pieceColor], sq)
 	pos.Hash ^= PieceZobristValues[pieceColor][pieceType][sq]
-	pos.Scores[pieceColor] += PieceSquareTable[pieceType][FlipSq[pieceColor][sq]]
+	if pieceType == Pawn {
+		pos.PawnHash ^= PieceZobristValues[pieceColor][Pawn][sq]
+	}
+	pos.MGScores[pieceColor] += MGPieceSquareTable[pieceType][FlipSq[pieceColor][sq]]
+	pos.EGScores[pieceColor] += EGPieceSquareTable[pieceType][FlipSq[pieceColor][sq]]
+	pos.Phase += PhaseValues[pieceType]
+	if activeNetwork != nil {
+		pos.Accumulator.addPiece(activeNetwork, pieceType, pieceColor, sq)
+	}
 }
 
 func (pos *Position) removePiece(pieceType, pieceColor, sq uint8) {
 	pos.Pieces[pieceType] = UnsetBit(pos.Pieces[pieceType], sq)
 	pos.Colors[pieceColor] = UnsetBit(pos.Colors[pieceColor], sq)
 	pos.Hash ^= PieceZobristValues[pieceColor][pieceType][sq]
-	pos.Scores[pieceColor] -= PieceSquareTable[pieceType][FlipSq[pieceColor][sq]]
+	if pieceType == Pawn {
+		pos.PawnHash ^= PieceZobristValues[pieceColor][Pawn][sq]
+	}
+	pos.MGScores[pieceColor] -= MGPieceSquareTable[pieceType][FlipSq[pieceColor][sq]]
+	pos.EGScores[pieceColor] -= EGPieceSquareTable[pieceType][FlipSq[pieceColor][sq]]
+	pos.Phase -= PhaseValues[pieceType]
+	if activeNetwork != nil {
+		pos.Accumulator.removePiece(activeNetwork, pieceType, pieceColor, sq)
+	}
 }
 
 func (pos *Position) GetPieceTypeOnSq(sq uint8) uint8 {
@@ -3,7 +3,10 @@ package engine
 import (
 	"eques/utils"
 	"fmt"
+	"math"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -11,11 +14,49 @@ const (
 	MaxDepth               = 60
 	MaxPly                 = 80
 	MaxGameLength          = 1024
+	DefaultTTSize          = 64
 	NullMove          Move = 0
 	LongestCheckmate int16 = 9000
-	BestMoveScore   uint16 = 8000
+
+	// Move ordering scores. Every score must fit into the 13 bits reserved for
+	// it in a move, and quiet moves are given a score centered around
+	// QuietMoveScore, offset by their history score.
+	BestMoveScore     uint16 = 8000
+	GoodCaptureScore  uint16 = 7000
+	FirstKillerScore  uint16 = 6000
+	SecondKillerScore uint16 = 5900
+	CounterMoveScore  uint16 = 5800
+	QuietMoveScore    uint16 = 3000
+	BadCaptureScore   uint16 = 500
+
+	MaxHistoryScore  int16 = 2000
+	MaxHistoryBonus  int16 = 400
+
+	NMPMinDepth          uint8 = 3
+	NMPBaseReduction     uint8 = 2
+	NMPDepthDivisor      uint8 = 4
+	NMPVerificationDepth uint8 = 10
+
+	AspirationMinDepth      uint8 = 5
+	AspirationWindowSize    int16 = 25
+	AspirationMaxWindowSize int16 = 500
+
+	LMRMinDepth      uint8 = 3
+	LMRMinMoveIdx    int   = 2
+	LMRMaxMoveIdx    int   = 63
 )
 
+var LMRReductions [MaxDepth + 1][LMRMaxMoveIdx + 1]uint8
+
+func InitSearchTables() {
+	for depth := 1; depth <= MaxDepth; depth++ {
+		for moveIdx := 1; moveIdx <= LMRMaxMoveIdx; moveIdx++ {
+			reduction := 0.75 + math.Log(float64(depth))*math.Log(float64(moveIdx))/2.25
+			LMRReductions[depth][moveIdx] = uint8(reduction)
+		}
+	}
+}
+
 var MVV_LVA [7][6]uint16 = [7][6]uint16{
 	{15, 14, 13, 12, 11, 10}, // victim is pawn
 	{25, 24, 23, 22, 21, 20}, // victim is knight
@@ -65,15 +106,48 @@ func (pv *PVLine) String() string {
 	return sb.String()
 }
 
+// Limits placed on a search, besides the time. A zero value for any limit means
+// it isn't used.
+type SearchLimits struct {
+	SearchMoves []Move
+	Nodes       uint64
+	Depth       uint8
+	Mate        uint8
+}
+
 type SearchData struct {
 	posStack    [MaxPly]Position
 	pvLineStack [MaxPly]PVLine
 	posHistory  [MaxGameLength]uint64
+	TT          TranspositionTable[SearchEntry]
 	Timer       Timer
+	Limits      SearchLimits
+	MultiPV     int
 	Pos         Position
 	prevPV      PVLine
-	totalNodes  uint64
+	helpers     []*SearchData
+	totalNodes  atomic.Uint64
 	historyIdx  uint16
+
+	killerMoves  [MaxPly][2]Move
+	counterMoves [2][64][64]Move
+	historyTable [2][64][64]int16
+	moveStack    [MaxPly]Move
+
+	excludedRootMoves []Move
+	pawnTable         TranspositionTable[PawnEntry]
+
+	// The root moves left after ranking them with the tablebases, the largest number
+	// of pieces for which the tablebases are probed during the search, and the number
+	// of successful probes.
+	tbRootMoves  []Move
+	tbProbeLimit int
+	tbHits       atomic.Uint64
+
+	// The score of the best move found by the last search, and whether to keep
+	// the search from reporting its progress, as when the engine plays itself.
+	bestScore int16
+	Silent    bool
 }
 
 func (sd *SearchData) Reset() {
@@ -82,6 +156,63 @@ func (sd *SearchData) Reset() {
 	sd.Pos = Position{}
 	sd.posHistory = [MaxGameLength]uint64{}
 	sd.historyIdx = 0
+	sd.killerMoves = [MaxPly][2]Move{}
+	sd.counterMoves = [2][64][64]Move{}
+	sd.historyTable = [2][64][64]int16{}
+
+	for _, helper := range sd.helpers {
+		helper.Reset()
+	}
+}
+
+// Set the number of threads used to search. The main thread is always the one
+// owning the search data, so numThreads-1 helper threads are created, each with
+// its own position stack, PV stack, and history.
+func (sd *SearchData) SetNumThreads(numThreads int) {
+	sd.helpers = make([]*SearchData, numThreads-1)
+	for i := range sd.helpers {
+		sd.helpers[i] = &SearchData{}
+	}
+}
+
+// Prepare a helper thread for a new search. Its counters are reset here, before any
+// thread starts, so the main thread never counts nodes left over from the last search.
+func (sd *SearchData) setupHelper(helper *SearchData) {
+	// Copying the table by value still shares its underlying entries,
+	// which is what lets every thread see each other's results.
+	helper.TT = sd.TT
+
+	CopyPos(&sd.Pos, &helper.Pos)
+	helper.posHistory = sd.posHistory
+	helper.historyIdx = sd.historyIdx
+	helper.Limits = SearchLimits{SearchMoves: sd.Limits.SearchMoves}
+	helper.tbRootMoves = sd.tbRootMoves
+	helper.tbProbeLimit = sd.tbProbeLimit
+	helper.totalNodes.Store(0)
+	helper.tbHits.Store(0)
+	helper.Timer.CalculateSearchTime(InfiniteTimeFormat, 0, 0, 0, 0)
+}
+
+func (sd *SearchData) evaluate() int16 {
+	return evaluate(&sd.Pos, &sd.pawnTable, nil)
+}
+
+// Count the nodes searched by every thread. Only the main thread has a node limit,
+// which it checks against this total, the same count it reports.
+func (sd *SearchData) nodesSearched() uint64 {
+	nodes := sd.totalNodes.Load()
+	for _, helper := range sd.helpers {
+		nodes += helper.totalNodes.Load()
+	}
+	return nodes
+}
+
+func (sd *SearchData) tbHitsCount() uint64 {
+	hits := sd.tbHits.Load()
+	for _, helper := range sd.helpers {
+		hits += helper.tbHits.Load()
+	}
+	return hits
 }
 
 func (sd *SearchData) AddCurrPosToHistory() {
@@ -101,59 +232,331 @@ func (sd *SearchData) GetCurrPV() PVLine {
 	return sd.pvLineStack[0]
 }
 
+// Get the hashes of the positions played so far, oldest first.
+func (sd *SearchData) GetPosHistory() []uint64 {
+	return sd.posHistory[:sd.historyIdx]
+}
+
+func (sd *SearchData) GetBestScore() int16 {
+	return sd.bestScore
+}
+
+// Search the current position using Lazy SMP. Every helper thread runs its own
+// iterative deepening loop on a copy of the position, communicating only through
+// the shared transposition table. The main thread reports the search and decides
+// the best move, and stops the helpers once it's finished.
 func Search(sd *SearchData) Move {
-	sd.totalNodes = 0
+	sd.TT.IncAge()
+	sd.Pos.refreshAccumulator()
+	probeRootTB(sd)
+
+	var wg sync.WaitGroup
+	for i, helper := range sd.helpers {
+		sd.setupHelper(helper)
+		wg.Add(1)
+		go func(helper *SearchData, threadID int) {
+			defer wg.Done()
+			iterativeDeepening(helper, threadID)
+		}(helper, i+1)
+	}
+
+	bestMove := iterativeDeepening(sd, 0)
+
+	for _, helper := range sd.helpers {
+		helper.Timer.Stopped.Store(true)
+	}
+
+	wg.Wait()
+	return bestMove
+}
+
+func iterativeDeepening(sd *SearchData, threadID int) Move {
+	sd.totalNodes.Store(0)
 	sd.prevPV.clear()
+	sd.pvLineStack[0].clear()
+
+	// Each thread keeps its own pawn table, allocated the first time it searches.
+	if sd.pawnTable.size == 0 {
+		sd.pawnTable.SetSize(PawnTableSize, PawnEntrySize)
+	}
 
 	bestMove := NullMove
+	sd.bestScore = 0
 	sd.Timer.Start()
-	totalTime := int64(0)
+	searchStart := time.Now()
+	isMainThread := threadID == 0
+
+	// Only the main thread searches multiple PV lines. The helpers stick to
+	// the best line, and contribute through the transposition table.
+	numPVs := 1
+	if isMainThread {
+		numRootMoves := countRootMoves(sd)
+		if numRootMoves == 0 {
+			return reportNoRootMoves(sd, searchStart)
+		}
+		numPVs = min(max(sd.MultiPV, 1), numRootMoves)
+	}
+
+	pvLines := make([]PVLine, numPVs)
+	scores := make([]int16, numPVs)
+	prevPVLines := make([]PVLine, numPVs)
+	prevScores := make([]int16, numPVs)
+
+	// Have every other helper thread start a depth further along, so the
+	// threads spread out over different depths rather than all searching
+	// the same tree in lock-step.
+	startDepth := uint8(1 + threadID%2)
+
+	maxDepth := uint8(MaxDepth)
+	if sd.Limits.Depth > 0 && sd.Limits.Depth < MaxDepth {
+		maxDepth = sd.Limits.Depth
+	}
+
+	for depth := startDepth; depth <= maxDepth; depth++ {
+		// Search the root once per PV line, each time excluding the best moves of
+		// the lines already found, so the k-th search finds the k-th best move.
+		sd.excludedRootMoves = sd.excludedRootMoves[:0]
+		for pvIdx := 0; pvIdx < numPVs; pvIdx++ {
+			scores[pvIdx] = aspirationWindowSearch(
+				sd, depth, pvIdx, prevScores[pvIdx], &prevPVLines[pvIdx], isMainThread, searchStart,
+			)
+
+			if sd.Timer.Stopped.Load() {
+				break
+			}
 
-	for depth := uint8(1); depth <= MaxDepth; depth++ {
-		startTime := time.Now()
-		score := negamax(sd, -InfinityCPValue, InfinityCPValue, depth, 0)
-		endTime := time.Since(startTime)
+			pvLines[pvIdx].copy(&sd.pvLineStack[0])
+			sd.excludedRootMoves = append(sd.excludedRootMoves, sd.pvLineStack[0].bestMove())
+		}
 
-		if sd.Timer.Stopped {
+		if sd.Timer.Stopped.Load() {
 			break
 		}
+
+		sortPVLines(pvLines, scores)
+		for pvIdx := 0; pvIdx < numPVs; pvIdx++ {
+			prevPVLines[pvIdx].copy(&pvLines[pvIdx])
+			prevScores[pvIdx] = scores[pvIdx]
+		}
 		
+		bestMove = pvLines[0].bestMove()
+		sd.bestScore = scores[0]
+		sd.prevPV.copy(&pvLines[0])
+
+		if isMainThread {
+			for pvIdx := 0; pvIdx < numPVs; pvIdx++ {
+				reportSearchInfo(sd, depth, pvIdx, scores[pvIdx], "", &pvLines[pvIdx], searchStart)
+			}
+		}
+
+		if sd.Limits.Mate > 0 && scores[0] >= LongestCheckmate && movesToMate(scores[0]) <= int16(sd.Limits.Mate) {
+			break
+		}
+	}
+
+	sd.excludedRootMoves = sd.excludedRootMoves[:0]
+
+	// If the search was stopped before the first iteration could finish, fall
+	// back to the best move found so far, or failing that the first legal root
+	// move, so there's always a move to play. Otherwise make sure the current PV
+	// is the one from the last completed iteration, rather than whatever was left
+	// of an unfinished one.
+	if bestMove == NullMove {
 		bestMove = sd.pvLineStack[0].bestMove()
-		totalTime += endTime.Milliseconds()
-		nps := (sd.totalNodes * 1000) / uint64(totalTime+1)
-
-		fmt.Printf(
-			"info depth %d time %d score %s nodes %d pv %snps %d\n",
-			depth,
-			totalTime,
-			convertToUCIScore(score), 
-			sd.totalNodes, 
-			&sd.pvLineStack[0],
-			nps,
-		)
-		
-		sd.prevPV.copy(&sd.pvLineStack[0])
+		if bestMove == NullMove {
+			if moves := legalRootMoves(sd); len(moves) > 0 {
+				bestMove = moves[0]
+			}
+		}
+	} else {
+		sd.pvLineStack[0].copy(&sd.prevPV)
 	}
 
 	return bestMove
 }
 
-func negamax(sd *SearchData, alpha, beta int16, depth, ply uint8) int16 {
-	if sd.totalNodes & 2047 == 0 {
+// Report the score of a root with no moves to search, since the side to move is
+// checkmated or stalemated, or none of the moves given with searchmoves are legal,
+// and return a null move, as there's nothing to play.
+func reportNoRootMoves(sd *SearchData, searchStart time.Time) Move {
+	score := int16(DrawCPValue)
+	if sd.Pos.IsSideInCheck(sd.Pos.Side) && len(GenLegalMoves(&sd.Pos)) == 0 {
+		score = -InfinityCPValue
+	}
+
+	sd.bestScore = score
+	sd.pvLineStack[0].clear()
+	reportSearchInfo(sd, 1, 0, score, "", &sd.pvLineStack[0], searchStart)
+	return NullMove
+}
+
+// Search the root using a narrow window centered on the score of the previous iteration,
+// since the score is unlikely to change much between iterations and a narrow window
+// causes many more cutoffs. If the true score falls outside of the window, the window
+// is widened on the side that failed, and the root searched again.
+func aspirationWindowSearch(sd *SearchData, depth uint8, pvIdx int, prevScore int16, prevPV *PVLine, isMainThread bool, searchStart time.Time) int16 {
+	if depth < AspirationMinDepth {
+		return negamax(sd, -InfinityCPValue, InfinityCPValue, depth, 0, true)
+	}
+
+	delta := AspirationWindowSize
+	alpha := max(prevScore-delta, -InfinityCPValue)
+	beta := min(prevScore+delta, InfinityCPValue)
+
+	for {
+		score := negamax(sd, alpha, beta, depth, 0, true)
+
+		if sd.Timer.Stopped.Load() {
+			return 0
+		}
+
+		if score <= alpha {
+			if isMainThread {
+				reportSearchInfo(sd, depth, pvIdx, score, " upperbound", prevPV, searchStart)
+			}
+			beta = (alpha + beta) / 2
+			alpha = max(score-delta, -InfinityCPValue)
+		} else if score >= beta {
+			if isMainThread {
+				reportSearchInfo(sd, depth, pvIdx, score, " lowerbound", &sd.pvLineStack[0], searchStart)
+			}
+			beta = min(score+delta, InfinityCPValue)
+		} else {
+			return score
+		}
+
+		// Widen the window progressively, until eventually falling back to a
+		// full-window search once the score is far from what was expected.
+		delta += delta
+		if delta > AspirationMaxWindowSize {
+			alpha = -InfinityCPValue
+			beta = InfinityCPValue
+		}
+	}
+}
+
+func reportSearchInfo(sd *SearchData, depth uint8, pvIdx int, score int16, bound string, pv *PVLine, searchStart time.Time) {
+	if sd.Silent {
+		return
+	}
+
+	totalTime := time.Since(searchStart).Milliseconds()
+	totalNodes := sd.nodesSearched()
+	nps := (totalNodes * 1000) / uint64(totalTime+1)
+
+	multiPV := ""
+	if sd.MultiPV > 1 {
+		multiPV = fmt.Sprintf(" multipv %d", pvIdx+1)
+	}
+
+	fmt.Printf(
+		"info depth %d%s time %d score %s%s nodes %d tbhits %d pv %snps %d\n",
+		depth,
+		multiPV,
+		totalTime,
+		convertToUCIScore(score),
+		bound,
+		totalNodes,
+		sd.tbHitsCount(),
+		pv,
+		nps,
+	)
+}
+
+// Sort the PV lines found in an iteration from best to worst. The lines are usually
+// already in order, but the scores of later lines can come back higher when the
+// search is unstable.
+func sortPVLines(pvLines []PVLine, scores []int16) {
+	for i := 1; i < len(pvLines); i++ {
+		for j := i; j > 0 && scores[j] > scores[j-1]; j-- {
+			scores[j], scores[j-1] = scores[j-1], scores[j]
+			pvLines[j], pvLines[j-1] = pvLines[j-1], pvLines[j]
+		}
+	}
+}
+
+// Rank the root moves with the tablebases when the root position is in them, so only
+// the moves which keep the best outcome are searched. When the moves were ranked with
+// the DTZ tables, or the position isn't won, probing during the search can't help
+// pick between the moves left, so it's turned off.
+func probeRootTB(sd *SearchData) {
+	sd.tbHits.Store(0)
+	sd.tbRootMoves = nil
+	sd.tbProbeLimit = SyzygyLargest()
+
+	if sd.tbProbeLimit == 0 || sd.Pos.Castling != 0 || tbPieceCount(&sd.Pos) > sd.tbProbeLimit {
+		return
+	}
+
+	moves := genMoves(&sd.Pos)
+	if len(sd.Limits.SearchMoves) > 0 {
+		moves = filterSearchMoves(moves, sd.Limits.SearchMoves)
+	}
+
+	rootMoves, usedDTZ := rankRootMovesWithTB(&sd.Pos, moves)
+	if len(rootMoves) == 0 {
+		return
+	}
+
+	sd.tbRootMoves = rootMoves
+	sd.tbHits.Store(uint64(len(moves)))
+
+	if wdl, ok := probeWDL(&sd.Pos); usedDTZ || !ok || wdl <= WDLDraw {
+		sd.tbProbeLimit = 0
+	}
+}
+
+func countRootMoves(sd *SearchData) int {
+	return len(legalRootMoves(sd))
+}
+
+// Get the legal moves the search may play at the root, which are limited to the
+// ones given with searchmoves when it's used.
+func legalRootMoves(sd *SearchData) []Move {
+	moves := genMoves(&sd.Pos)
+	if len(sd.Limits.SearchMoves) > 0 {
+		moves = filterSearchMoves(moves, sd.Limits.SearchMoves)
+	}
+	if len(sd.tbRootMoves) > 0 {
+		moves = filterSearchMoves(moves, sd.tbRootMoves)
+	}
+
+	legalMoves := make([]Move, 0, len(moves))
+	for _, move := range moves {
+		CopyPos(&sd.Pos, &sd.posStack[0])
+		sd.Pos.DoMove(move)
+		if !sd.Pos.IsSideInCheck(sd.Pos.Side ^ 1) {
+			legalMoves = append(legalMoves, move)
+		}
+		CopyPos(&sd.posStack[0], &sd.Pos)
+	}
+
+	return legalMoves
+}
+
+func negamax(sd *SearchData, alpha, beta int16, depth, ply uint8, doNull bool) int16 {
+	if sd.totalNodes.Load() & 2047 == 0 {
 		sd.Timer.Update()
 	}
 
-	if sd.Timer.Stopped {
+	// Summing the nodes of every thread touches each of their counters, so like
+	// the time, the node limit is only checked every so often.
+	if sd.Limits.Nodes > 0 && sd.totalNodes.Load()&1023 == 0 && sd.nodesSearched() >= sd.Limits.Nodes {
+		sd.Timer.Stopped.Store(true)
+	}
+
+	if sd.Timer.Stopped.Load() {
 		return 0
 	}
 
 	if ply >= MaxPly {
-		return EvaluatePosition(&sd.Pos)
+		return sd.evaluate()
 	}
 
 	sd.pvLineStack[ply].clear()
 
 	isRoot := ply == 0
+	isPVNode := beta-alpha != 1
 	inCheck := sd.Pos.IsSideInCheck(sd.Pos.Side)
 
 	if !isRoot && nodeIsDraw(sd) {
@@ -168,13 +571,107 @@ func negamax(sd *SearchData, alpha, beta int16, depth, ply uint8) int16 {
 		return Qsearch(sd, alpha, beta, ply)
 	}
 
-	sd.totalNodes++
-	noLegalMovesFlag := true
+	sd.totalNodes.Add(1)
+	legalMoves := 0
+
+	ttMove := sd.prevPV.Moves[ply]
+	if entry, ok := probeEntry(sd); ok {
+		// Only cut off at non-PV nodes, since the transposition table can't give
+		// the rest of the principal variation.
+		ttScore, shouldUse := entry.Get(depth, ply, alpha, beta)
+		if shouldUse && !isRoot && !isPVNode {
+			return ttScore
+		}
+		if entry.Move() != NullMove {
+			ttMove = entry.Move()
+		}
+	}
+
+	// Probe the generated distance to mate tablebases, which give the exact score
+	// of the position, so the search never has to look any deeper.
+	if !isRoot && len(dtmTables) > 0 && sd.Pos.EPSq == NoSq && sd.Pos.Castling == 0 &&
+		tbPieceCount(&sd.Pos) <= DTMMaxPieces {
+		if dtmScore, ok := probeDTM(&sd.Pos); ok {
+			sd.tbHits.Add(1)
+			score := dtmSearchScore(dtmScore, ply)
+			storeEntry(sd, NullMove, score, MaxDepth, ply, ExactFlag)
+			return score
+		}
+	}
+
+	// Probe the tablebases right after a capture or pawn move brings the position
+	// into them. The tablebases ignore castling rights, so positions with any are
+	// skipped. A win or loss is only a bound, since a quicker mate could be found.
+	if !isRoot && sd.tbProbeLimit > 0 && sd.Pos.HalfMove == 0 && sd.Pos.Castling == 0 &&
+		tbPieceCount(&sd.Pos) <= sd.tbProbeLimit {
+		if wdl, ok := probeWDL(&sd.Pos); ok {
+			sd.tbHits.Add(1)
+			score, flag := tbScore(wdl, ply)
+			if flag == ExactFlag || (flag == LowerBoundFlag && score >= beta) || (flag == UpperBoundFlag && score <= alpha) {
+				storeEntry(sd, NullMove, score, min(depth+TBStoreDepthBonus, MaxDepth), ply, flag)
+				return score
+			}
+		}
+	}
+
+	// Null move pruning. Give the opponent a free move, and if a reduced depth search
+	// still fails high, the position is almost certainly good enough to cutoff. This
+	// assumption breaks down in zugzwang, so avoid it when in check, twice in a row, and
+	// when the side to move has only pawns left, and verify the result at high depths.
+	if !isRoot && !isPVNode && !inCheck && doNull && depth >= NMPMinDepth &&
+		sd.Pos.hasNonPawnMaterial(sd.Pos.Side) && sd.evaluate() >= beta {
+		R := NMPBaseReduction + depth/NMPDepthDivisor
+		reducedDepth := uint8(0)
+		if depth > R+1 {
+			reducedDepth = depth - R - 1
+		}
+
+		CopyPos(&sd.Pos, &sd.posStack[ply])
+		sd.Pos.DoNullMove()
+		sd.AddCurrPosToHistory()
+		sd.moveStack[ply] = NullMove
+
+		score := -negamax(sd, -beta, -beta+1, reducedDepth, ply+1, false)
+
+		CopyPos(&sd.posStack[ply], &sd.Pos)
+		sd.PopFromPosHistory()
+
+		if sd.Timer.Stopped.Load() {
+			return 0
+		}
+
+		if score >= beta {
+			if depth < NMPVerificationDepth {
+				return beta
+			}
+
+			score = negamax(sd, beta-1, beta, reducedDepth, ply, false)
+			if score >= beta {
+				return beta
+			}
+		}
+	}
 
 	moves := genMoves(&sd.Pos)
-	scoreMoves(sd, moves, sd.prevPV.Moves[ply])
+	if isRoot && len(sd.Limits.SearchMoves) > 0 {
+		moves = filterSearchMoves(moves, sd.Limits.SearchMoves)
+	}
+
+	if isRoot && len(sd.tbRootMoves) > 0 {
+		moves = filterSearchMoves(moves, sd.tbRootMoves)
+	}
+
+	if isRoot && len(sd.excludedRootMoves) > 0 {
+		moves = removeExcludedMoves(moves, sd.excludedRootMoves)
+	}
+
+	scoreMoves(sd, moves, ttMove, ply)
 	moveOrderer := createMoveOrderer(moves)
 
+	ttFlag := UpperBoundFlag
+	bestMove := NullMove
+	quietsSearched := make([]Move, 0, len(moves))
+
 	for move := moveOrderer(); move != NullMove; move = moveOrderer() {
 		CopyPos(&sd.Pos, &sd.posStack[ply])
 		sd.Pos.DoMove(move)
@@ -185,50 +682,140 @@ func negamax(sd *SearchData, alpha, beta int16, depth, ply uint8) int16 {
 		}
 
 		sd.AddCurrPosToHistory()
+		sd.moveStack[ply] = move
+		legalMoves++
 
-		noLegalMovesFlag = false
-		score := -negamax(sd, -beta, -alpha, depth-1, ply+1)
+		score := int16(0)
+		if legalMoves == 1 {
+			score = -negamax(sd, -beta, -alpha, depth-1, ply+1, true)
+		} else {
+			// Principal variation search. Assume the first move was the best and
+			// prove every other move is worse with a cheaper zero-window search,
+			// which late, unpromising moves get at a reduced depth. Only when the
+			// proof fails is the move re-searched at full depth and window.
+			reduction := lateMoveReduction(sd, move, depth, legalMoves, isPVNode, inCheck)
+			score = -negamax(sd, -alpha-1, -alpha, depth-1-reduction, ply+1, true)
+
+			if score > alpha && reduction > 0 {
+				score = -negamax(sd, -alpha-1, -alpha, depth-1, ply+1, true)
+			}
+
+			if score > alpha && score < beta {
+				score = -negamax(sd, -beta, -alpha, depth-1, ply+1, true)
+			}
+		}
 
 		CopyPos(&sd.posStack[ply], &sd.Pos)
 		sd.PopFromPosHistory()
 
+		isQuiet := !move.IsCapture() && !move.IsPromotion()
+
 		if score >= beta {
+			// Keep the move which failed high at the root, so there's still a
+			// best move to report when the aspiration window's too narrow.
+			if isRoot {
+				sd.pvLineStack[ply].update(move, &sd.pvLineStack[ply+1])
+			}
+			if isQuiet {
+				updateQuietMoveHeuristics(sd, move, quietsSearched, depth, ply)
+			}
+			storeEntry(sd, move, beta, depth, ply, LowerBoundFlag)
 			return beta
 		}
 
 		if score > alpha {
 			sd.pvLineStack[ply].update(move, &sd.pvLineStack[ply+1])
 			alpha = score
+			bestMove = move
+			ttFlag = ExactFlag
+		}
+
+		if isQuiet {
+			quietsSearched = append(quietsSearched, move)
 		}
 	}
 
-	if noLegalMovesFlag {
+	if legalMoves == 0 {
 		if inCheck {
 			return -InfinityCPValue + int16(ply)
 		}
 		return DrawCPValue
 	}
 
+	storeEntry(sd, bestMove, alpha, depth, ply, ttFlag)
 	return alpha
 }
 
+// Compute how much to reduce the search depth of a move that isn't the first to
+// be searched. Should be called after the move's been made.
+func lateMoveReduction(sd *SearchData, move Move, depth uint8, moveIdx int, isPVNode, inCheck bool) uint8 {
+	if depth < LMRMinDepth || moveIdx <= LMRMinMoveIdx || inCheck || move.IsPromotion() {
+		return 0
+	}
+
+	// Moves giving check are forcing, so searching them properly is worth the cost.
+	if sd.Pos.IsSideInCheck(sd.Pos.Side) {
+		return 0
+	}
+
+	if moveIdx > LMRMaxMoveIdx {
+		moveIdx = LMRMaxMoveIdx
+	}
+
+	reduction := LMRReductions[depth][moveIdx]
+	if move.IsCapture() {
+		reduction /= 2
+	}
+
+	if isPVNode && reduction > 0 {
+		reduction--
+	}
+
+	// Never reduce a move straight into quiescence search.
+	if reduction > depth-2 {
+		reduction = depth - 2
+	}
+
+	return reduction
+}
+
 func Qsearch(sd *SearchData, alpha, beta int16, ply uint8) int16 {
-	if sd.totalNodes & 2047 == 0 {
+	if sd.totalNodes.Load() & 2047 == 0 {
 		sd.Timer.Update()
 	}
 
-	if sd.Timer.Stopped {
+	if sd.Limits.Nodes > 0 && sd.totalNodes.Load()&1023 == 0 && sd.nodesSearched() >= sd.Limits.Nodes {
+		sd.Timer.Stopped.Store(true)
+	}
+
+	if sd.Timer.Stopped.Load() {
 		return 0
 	}
 
 	if ply >= MaxPly {
-		return EvaluatePosition(&sd.Pos)
+		return sd.evaluate()
 	}
 
-	sd.totalNodes++
+	sd.totalNodes.Add(1)
 
 	sd.pvLineStack[ply].clear()
-	eval := EvaluatePosition(&sd.Pos)
+
+	isPVNode := beta-alpha != 1
+
+	ttMove := sd.prevPV.Moves[ply]
+	if entry, ok := probeEntry(sd); ok {
+		// As in the main search, only cut off at non-PV nodes, so the
+		// principal variation isn't cut short.
+		ttScore, shouldUse := entry.Get(0, ply, alpha, beta)
+		if shouldUse && !isPVNode {
+			return ttScore
+		}
+		if entry.Move() != NullMove {
+			ttMove = entry.Move()
+		}
+	}
+
+	eval := sd.evaluate()
 
 	if eval >= beta {
 		return beta
@@ -239,10 +826,20 @@ func Qsearch(sd *SearchData, alpha, beta int16, ply uint8) int16 {
 	}
 
 	moves := genAttacksAndQueenPromos(&sd.Pos)
-	scoreMoves(sd, moves, sd.prevPV.Moves[ply])
+	scoreMoves(sd, moves, ttMove, ply)
 	moveOrderer := createMoveOrderer(moves)
 
+	ttFlag := UpperBoundFlag
+	bestMove := NullMove
+
 	for move := moveOrderer(); move != NullMove; move = moveOrderer() {
+		// Prune captures which lose material, since they're almost never going to
+		// raise alpha. Such captures were already given scores below every good
+		// capture when they were ordered, so there's no need to compute SEE again.
+		if move.Score() < GoodCaptureScore {
+			continue
+		}
+
 		CopyPos(&sd.Pos, &sd.posStack[ply])
 		sd.Pos.DoMove(move)
 
@@ -252,19 +849,22 @@ func Qsearch(sd *SearchData, alpha, beta int16, ply uint8) int16 {
 		}
 
 		score := -Qsearch(sd, -beta, -alpha, ply+1)
+		CopyPos(&sd.posStack[ply], &sd.Pos)
 
 		if score >= beta {
+			storeEntry(sd, move, beta, 0, ply, LowerBoundFlag)
 			return beta
 		}
 
 		if score > alpha {
 			sd.pvLineStack[ply].update(move, &sd.pvLineStack[ply+1])
 			alpha = score
+			bestMove = move
+			ttFlag = ExactFlag
 		}
-
-		CopyPos(&sd.posStack[ply], &sd.Pos)
 	}
 
+	storeEntry(sd, bestMove, alpha, 0, ply, ttFlag)
 	return alpha
 }
 
@@ -295,18 +895,109 @@ func createMoveOrderer(moves []Move) func() Move {
 	}
 }
 
-func scoreMoves(sd *SearchData, moves []Move, bestMoveFromPrevDepth Move) {
+func scoreMoves(sd *SearchData, moves []Move, ttMove Move, ply uint8) {
+	counterMove := NullMove
+	if ply > 0 {
+		prevMove := sd.moveStack[ply-1]
+		counterMove = sd.counterMoves[sd.Pos.Side][prevMove.FromSq()][prevMove.ToSq()]
+	}
+
 	for i := 0; i < len(moves); i++ {
 		move := &moves[i]
-		if move.Equal(bestMoveFromPrevDepth) {
+		if move.Equal(ttMove) {
 			move.SetScore(BestMoveScore)
+		} else if move.IsCapture() || move.IsPromotion() {
+			victimType := sd.Pos.GetPieceTypeOnSq(move.ToSq())
+			if move.Type() == WhiteAttackEP || move.Type() == BlackAttackEP {
+				victimType = Pawn
+			}
+			mvv_lva_score := MVV_LVA[victimType][move.FromType()]
+
+			// Captures losing material are unlikely to be any good, so
+			// try them only after every quiet move.
+			if sd.Pos.SEEGreaterOrEqual(*move, 0) {
+				move.SetScore(GoodCaptureScore + mvv_lva_score)
+			} else {
+				move.SetScore(BadCaptureScore + mvv_lva_score)
+			}
+		} else if move.Equal(sd.killerMoves[ply][0]) {
+			move.SetScore(FirstKillerScore)
+		} else if move.Equal(sd.killerMoves[ply][1]) {
+			move.SetScore(SecondKillerScore)
+		} else if move.Equal(counterMove) {
+			move.SetScore(CounterMoveScore)
 		} else {
-			mvv_lva_score := MVV_LVA[sd.Pos.GetPieceTypeOnSq(move.ToSq())][move.FromType()]
-			move.SetScore(mvv_lva_score)
+			history := sd.historyTable[sd.Pos.Side][move.FromSq()][move.ToSq()]
+			move.SetScore(uint16(int16(QuietMoveScore) + history))
 		}
 	}
 }
 
+// Update the killer, countermove, and history tables after a quiet move caused a beta
+// cutoff. Every quiet move searched before it failed to do so, and is penalized.
+func updateQuietMoveHeuristics(sd *SearchData, move Move, quietsSearched []Move, depth, ply uint8) {
+	if !move.Equal(sd.killerMoves[ply][0]) {
+		sd.killerMoves[ply][1] = sd.killerMoves[ply][0]
+		sd.killerMoves[ply][0] = move
+	}
+
+	if ply > 0 {
+		prevMove := sd.moveStack[ply-1]
+		sd.counterMoves[sd.Pos.Side][prevMove.FromSq()][prevMove.ToSq()] = move
+	}
+
+	bonus := int16(depth) * int16(depth)
+	if bonus > MaxHistoryBonus {
+		bonus = MaxHistoryBonus
+	}
+
+	updateHistory(sd, move, bonus)
+	for _, quiet := range quietsSearched {
+		updateHistory(sd, quiet, -bonus)
+	}
+}
+
+// Apply a bonus (or penalty) to a move's history score. The bonus shrinks the closer
+// the score gets to the maximum, which keeps every score within the bounds needed
+// to order the moves, and lets old scores decay in favor of newer ones.
+func updateHistory(sd *SearchData, move Move, bonus int16) {
+	history := &sd.historyTable[sd.Pos.Side][move.FromSq()][move.ToSq()]
+	gravity := int32(*history) * int32(utils.Abs(bonus)) / int32(MaxHistoryScore)
+	*history += bonus - int16(gravity)
+}
+
+// Probe the transposition table for the current position. The entry is copied
+// out of the table before it's checked, so another thread overwriting the slot
+// can't change it from under us once it's been validated.
+func probeEntry(sd *SearchData) (SearchEntry, bool) {
+	if sd.TT.size == 0 {
+		return SearchEntry{}, false
+	}
+
+	entryPtr := sd.TT.Probe(sd.Pos.Hash)
+	if entryPtr == nil {
+		return SearchEntry{}, false
+	}
+
+	entry := *entryPtr
+	return entry, entry.Hash() == sd.Pos.Hash
+}
+
+func storeEntry(sd *SearchData, move Move, score int16, depth, ply, flag uint8) {
+	// Scores returned after the timer has stopped are meaningless, so
+	// make sure they never make it into the table.
+	if sd.TT.size == 0 || sd.Timer.Stopped.Load() {
+		return
+	}
+
+	// The score of the root while some moves are excluded for MultiPV isn't the
+	// score of the position, so storing it would only mislead later searches.
+	if ply == 0 && len(sd.excludedRootMoves) > 0 {
+		return
+	}
+	sd.TT.Store(sd.Pos.Hash, depth).SetData(sd.Pos.Hash, move, score, depth, ply, flag, sd.TT.Age())
+}
+
 func nodeIsDraw(sd *SearchData) bool {
 	if sd.Pos.HalfMove >= 100 {
 		return true
@@ -321,13 +1012,50 @@ func nodeIsDraw(sd *SearchData) bool {
 	return false
 }
 
-func convertToUCIScore(score int16) string {
+func filterSearchMoves(moves, searchMoves []Move) []Move {
+	filtered := make([]Move, 0, len(searchMoves))
+	for _, move := range moves {
+		for _, searchMove := range searchMoves {
+			if move.Equal(searchMove) {
+				filtered = append(filtered, move)
+				break
+			}
+		}
+	}
+	return filtered
+}
+
+func removeExcludedMoves(moves, excludedMoves []Move) []Move {
+	remaining := make([]Move, 0, len(moves))
+	for _, move := range moves {
+		excluded := false
+		for _, excludedMove := range excludedMoves {
+			if move.Equal(excludedMove) {
+				excluded = true
+				break
+			}
+		}
+		if !excluded {
+			remaining = append(remaining, move)
+		}
+	}
+	return remaining
+}
+
+func movesToMate(score int16) int16 {
 	scoreAbs := utils.Abs(score)
-	if scoreAbs >= LongestCheckmate && scoreAbs % 2 == 0 {
-		return fmt.Sprintf("mate %d", (InfinityCPValue - scoreAbs) / 2)
+	if scoreAbs % 2 == 0 {
+		return (InfinityCPValue - scoreAbs) / 2
+	}
+	return (InfinityCPValue - scoreAbs) / 2 + 1
+}
+
+func convertToUCIScore(score int16) string {
+	if score >= LongestCheckmate {
+		return fmt.Sprintf("mate %d", movesToMate(score))
 	}
-	if scoreAbs >= LongestCheckmate && scoreAbs % 2 == 1 {
-		return fmt.Sprintf("mate %d", (InfinityCPValue - scoreAbs) / 2 + 1)
+	if score <= -LongestCheckmate {
+		return fmt.Sprintf("mate %d", -movesToMate(score))
 	}
 	return fmt.Sprintf("cp %d", score)
 }
\ No newline at end of file
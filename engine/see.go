@@ -0,0 +1,190 @@
+package engine
+
+const MaxSEESwaps = 32
+
+// The values of each piece type, indexed by type, used by static exchange evaluation. The
+// king is given a large value so a capture by the king is never considered a good trade
+// when the square is still defended.
+var SEEPieceValues = [7]int16{100, 300, 300, 500, 900, 5000, 0}
+
+// Statically evaluate the sequence of captures started by the given move on its
+// destination square, assuming each side always recaptures with its least valuable
+// attacker, and may stop capturing whenever doing so would lose material. The score
+// returned is from the perspective of the side making the move.
+func (pos *Position) SEE(move Move) int16 {
+	toSq := move.ToSq()
+	fromSq := move.FromSq()
+
+	var gain [MaxSEESwaps]int32
+	occupiedBB := pos.Colors[White] | pos.Colors[Black]
+
+	attackerType := move.FromType()
+	gain[0] = int32(SEEPieceValues[pos.GetPieceTypeOnSq(toSq)])
+
+	switch move.Type() {
+	case WhiteAttackEP:
+		gain[0] = int32(SEEPieceValues[Pawn])
+		occupiedBB = UnsetBit(occupiedBB, toSq-8)
+	case BlackAttackEP:
+		gain[0] = int32(SEEPieceValues[Pawn])
+		occupiedBB = UnsetBit(occupiedBB, toSq+8)
+	}
+
+	if move.IsPromotion() {
+		attackerType = promotionType(move)
+		gain[0] += int32(SEEPieceValues[attackerType] - SEEPieceValues[Pawn])
+	}
+
+	occupiedBB = UnsetBit(occupiedBB, fromSq)
+	attackersBB := pos.attackersOfSq(toSq, occupiedBB) & occupiedBB
+	side := pos.Side ^ 1
+	depth := 0
+
+	for depth < MaxSEESwaps-1 {
+		depth++
+
+		// Speculatively store the value of the piece last moved to the square, in case
+		// the current side has an attacker to capture it with.
+		gain[depth] = int32(SEEPieceValues[attackerType]) - gain[depth-1]
+		if max(-gain[depth-1], gain[depth]) < 0 {
+			break
+		}
+
+		sq, pieceType := pos.leastValuableAttacker(attackersBB & pos.Colors[side])
+		if pieceType == NoType {
+			break
+		}
+
+		occupiedBB = UnsetBit(occupiedBB, sq)
+		attackersBB = pos.updateXRayAttackers(toSq, attackersBB, occupiedBB) & occupiedBB
+		attackerType = pieceType
+		side ^= 1
+	}
+
+	for depth--; depth > 0; depth-- {
+		gain[depth-1] = -max(-gain[depth-1], gain[depth])
+	}
+
+	return int16(gain[0])
+}
+
+// Determine whether the static exchange evaluation of a move is at least the given
+// threshold. This is cheaper than computing the full evaluation, since the exchange
+// can be abandoned as soon as its outcome relative to the threshold is known.
+func (pos *Position) SEEGreaterOrEqual(move Move, threshold int16) bool {
+	toSq := move.ToSq()
+	fromSq := move.FromSq()
+	occupiedBB := pos.Colors[White] | pos.Colors[Black]
+
+	attackerType := move.FromType()
+	victimValue := int32(SEEPieceValues[pos.GetPieceTypeOnSq(toSq)])
+
+	switch move.Type() {
+	case WhiteAttackEP:
+		victimValue = int32(SEEPieceValues[Pawn])
+		occupiedBB = UnsetBit(occupiedBB, toSq-8)
+	case BlackAttackEP:
+		victimValue = int32(SEEPieceValues[Pawn])
+		occupiedBB = UnsetBit(occupiedBB, toSq+8)
+	}
+
+	if move.IsPromotion() {
+		attackerType = promotionType(move)
+		victimValue += int32(SEEPieceValues[attackerType] - SEEPieceValues[Pawn])
+	}
+
+	// If capturing the piece doesn't reach the threshold, the exchange never will. And
+	// if the threshold's still reached even after losing the capturing piece, there's
+	// no need to look any further.
+	balance := victimValue - int32(threshold)
+	if balance < 0 {
+		return false
+	}
+
+	balance = int32(SEEPieceValues[attackerType]) - balance
+	if balance <= 0 {
+		return true
+	}
+
+	occupiedBB = UnsetBit(occupiedBB, fromSq)
+	attackersBB := pos.attackersOfSq(toSq, occupiedBB) & occupiedBB
+	side := pos.Side
+	result := true
+
+	for {
+		side ^= 1
+		attackersBB &= occupiedBB
+
+		sq, pieceType := pos.leastValuableAttacker(attackersBB & pos.Colors[side])
+		if pieceType == NoType {
+			break
+		}
+
+		// The king can only recapture if the other side has no attackers left.
+		if pieceType == King {
+			if attackersBB & pos.Colors[side^1] != 0 {
+				return result
+			}
+			return !result
+		}
+
+		// Flip the balance to the current side's perspective. If even losing the
+		// capturing piece still leaves them ahead, they've won the exchange.
+		result = !result
+		balance = int32(SEEPieceValues[pieceType]) - balance
+		if balance < 0 || (balance == 0 && result) {
+			break
+		}
+
+		occupiedBB = UnsetBit(occupiedBB, sq)
+		attackersBB = pos.updateXRayAttackers(toSq, attackersBB, occupiedBB)
+	}
+
+	return result
+}
+
+// Get a bitboard of the pieces of both colors attacking the given square, given
+// the occupancy of the board.
+func (pos *Position) attackersOfSq(sq uint8, occupiedBB uint64) uint64 {
+	bishopsAndQueens := pos.Pieces[Bishop] | pos.Pieces[Queen]
+	rooksAndQueens := pos.Pieces[Rook] | pos.Pieces[Queen]
+
+	return (PawnAttacks[White][sq] & pos.Pieces[Pawn] & pos.Colors[Black]) |
+		(PawnAttacks[Black][sq] & pos.Pieces[Pawn] & pos.Colors[White]) |
+		(KnightMoves[sq] & pos.Pieces[Knight]) |
+		(KingMoves[sq] & pos.Pieces[King]) |
+		(LookupBishopMoves(sq, occupiedBB) & bishopsAndQueens) |
+		(LookupRookMoves(sq, occupiedBB) & rooksAndQueens)
+}
+
+// Add any sliders that were hidden behind a piece which just moved to
+// capture on the square.
+func (pos *Position) updateXRayAttackers(sq uint8, attackersBB, occupiedBB uint64) uint64 {
+	bishopsAndQueens := pos.Pieces[Bishop] | pos.Pieces[Queen]
+	rooksAndQueens := pos.Pieces[Rook] | pos.Pieces[Queen]
+
+	attackersBB |= LookupBishopMoves(sq, occupiedBB) & bishopsAndQueens
+	attackersBB |= LookupRookMoves(sq, occupiedBB) & rooksAndQueens
+	return attackersBB
+}
+
+func (pos *Position) leastValuableAttacker(attackersBB uint64) (uint8, uint8) {
+	for pieceType := uint8(Pawn); pieceType <= King; pieceType++ {
+		if pieceAttackers := attackersBB & pos.Pieces[pieceType]; pieceAttackers != 0 {
+			return GetLSBpos(pieceAttackers), pieceType
+		}
+	}
+	return NoSq, NoType
+}
+
+func promotionType(move Move) uint8 {
+	switch move.Type() {
+	case PromoN, PromoAttkN:
+		return Knight
+	case PromoB, PromoAttkB:
+		return Bishop
+	case PromoR, PromoAttkR:
+		return Rook
+	}
+	return Queen
+}
@@ -0,0 +1,1310 @@
+package engine
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// A pure Go implementation of Syzygy tablebase probing, closely following the
+// probing code Ronald de Man wrote alongside the tablebase generator, as well as
+// its port in Stockfish. WDL (.rtbw) tables give the win/draw/loss outcome of a
+// position, taking the fifty move rule into account, while DTZ (.rtbz) tables
+// give the distance to the next capture or pawn move (zeroing the fifty move
+// counter) on the way to that outcome.
+
+const (
+	TBMaxPieces = 7
+
+	// Tablebase wins are scored below every checkmate score, but above any score
+	// the evaluation could give, so the search always prefers a forced mate, but
+	// never gives up a tablebase win otherwise.
+	TBWinScore int16 = LongestCheckmate - MaxPly - 1
+
+	// How far deeper than the current depth a tablebase result is considered to
+	// be searched when stored in the transposition table, since it's exact.
+	TBStoreDepthBonus uint8 = 6
+
+	// The rank given to root moves winning within the fifty move rule. It's larger
+	// than any DTZ value, so a cursed win ranked by its DTZ still ranks above a draw,
+	// and a blessed loss below it.
+	tbMaxDTZ = 1 << 18
+)
+
+// Win/draw/loss outcomes from the perspective of the side to move. A cursed win
+// is a win that can't be forced within the fifty move rule, and a blessed loss
+// a loss which the fifty move rule saves.
+const (
+	WDLLoss        = -2
+	WDLBlessedLoss = -1
+	WDLDraw        = 0
+	WDLCursedWin   = 1
+	WDLWin         = 2
+)
+
+const (
+	tbProbeFail = iota
+	tbProbeOK
+	tbProbeChangeSTM
+	tbProbeZeroingBestMove
+)
+
+// Flags stored for each table in a file.
+const (
+	tbFlagSTM         = 1
+	tbFlagMapped      = 2
+	tbFlagWinPlies    = 4
+	tbFlagLossPlies   = 8
+	tbFlagWide        = 16
+	tbFlagSingleValue = 128
+)
+
+var tbWDLMagic = [4]byte{0x71, 0xe8, 0x23, 0x5d}
+var tbDTZMagic = [4]byte{0xd7, 0x66, 0x0c, 0xa5}
+
+// Tables used to compute the index of a position in a tablebase file.
+var tbMapPawns [64]int
+var tbMapB1H1H7 [64]int
+var tbMapA1D1D4 [64]int
+var tbMapKK [10][64]uint64
+var tbBinomial [6][64]uint64
+var tbLeadPawnIdx [6][64]uint64
+var tbLeadPawnsSize [6][4]uint64
+
+// The compression data of a single table. A file stores a table for each side to
+// move (unless both sides have the same pieces, or it's a DTZ file), and positions
+// with pawns are split further into a table for each file of the leading pawn.
+// All offsets are positions in the file's data.
+type tbPairsData struct {
+	flags           uint8
+	sizeofBlock     uint64
+	span            uint64
+	numBlocks       uint64
+	maxSymLen       int
+	minSymLen       int
+	lowestSym       int
+	btree           int
+	blockLength     int
+	blockLengthSize uint64
+	sparseIndex     int
+	sparseIndexSize uint64
+	blocks          int
+	base64          []uint64
+	symlen          []uint8
+	pieces          [TBMaxPieces]uint8
+	groupIdx        [TBMaxPieces + 1]uint64
+	groupLen        [TBMaxPieces + 1]int
+	mapIdx          [4]uint16
+}
+
+type tbTable struct {
+	path  string
+	isDTZ bool
+
+	// The material key of the table, and the key of the same material with the
+	// colors swapped, e.g. KRvK and KvKR.
+	key  string
+	key2 string
+
+	pieceCount      int
+	hasPawns        bool
+	hasUniquePieces bool
+	pawnCount       [2]int
+
+	loadOnce sync.Once
+	loaded   bool
+	data     []byte
+	items    [2][4]tbPairsData
+	dtzMap   int
+}
+
+type tbEntry struct {
+	wdl *tbTable
+	dtz *tbTable
+}
+
+var tablebases = struct {
+	entries map[string]*tbEntry
+	largest int
+}{}
+
+func genSyzygyTables() {
+	code := 0
+	for sq := uint8(0); sq < 64; sq++ {
+		if offA1H8(sq) < 0 {
+			tbMapB1H1H7[sq] = code
+			code++
+		}
+	}
+
+	// Squares in the a1-d1-d4 triangle are mapped below the squares on its diagonal.
+	code = 0
+	diagonal := []uint8{}
+	for sq := uint8(A1); sq <= D4; sq++ {
+		if offA1H8(sq) < 0 && FileOf(sq) <= FileD {
+			tbMapA1D1D4[sq] = code
+			code++
+		} else if offA1H8(sq) == 0 && FileOf(sq) <= FileD {
+			diagonal = append(diagonal, sq)
+		}
+	}
+	for _, sq := range diagonal {
+		tbMapA1D1D4[sq] = code
+		code++
+	}
+
+	// Map the 462 legal placements of two kings, where the first is in the a1-d1-d4
+	// triangle, and the second is never above the a1-h8 diagonal when the first is
+	// on it. Placements with both kings on the diagonal are mapped last.
+	type kingPair struct {
+		idx int
+		sq  uint8
+	}
+	bothOnDiagonal := []kingPair{}
+	code = 0
+	for idx := 0; idx < 10; idx++ {
+		for sq1 := uint8(A1); sq1 <= D4; sq1++ {
+			if tbMapA1D1D4[sq1] != idx || (idx == 0 && sq1 != B1) {
+				continue
+			}
+			for sq2 := uint8(0); sq2 < 64; sq2++ {
+				if IsBitset(SetBit(KingMoves[sq1], sq1), sq2) {
+					continue
+				} else if offA1H8(sq1) == 0 && offA1H8(sq2) > 0 {
+					continue
+				} else if offA1H8(sq1) == 0 && offA1H8(sq2) == 0 {
+					bothOnDiagonal = append(bothOnDiagonal, kingPair{idx, sq2})
+				} else {
+					tbMapKK[idx][sq2] = uint64(code)
+					code++
+				}
+			}
+		}
+	}
+	for _, pair := range bothOnDiagonal {
+		tbMapKK[pair.idx][pair.sq] = uint64(code)
+		code++
+	}
+
+	tbBinomial[0][0] = 1
+	for n := 1; n < 64; n++ {
+		for k := 0; k < 6 && k <= n; k++ {
+			if k > 0 {
+				tbBinomial[k][n] += tbBinomial[k-1][n-1]
+			}
+			if k < n {
+				tbBinomial[k][n] += tbBinomial[k][n-1]
+			}
+		}
+	}
+
+	// The leading pawn is the one furthest toward the edge, and among those on the
+	// same file, the one with the lowest rank. Mapping the squares so the leading
+	// pawn has the highest value also gives the number of squares left for the
+	// other pawns when the leading pawn's on that square.
+	availableSquares := 47
+	for leadPawnsCnt := 1; leadPawnsCnt <= 5; leadPawnsCnt++ {
+		for file := FileA; file <= FileD; file++ {
+			idx := uint64(0)
+			for rank := Rank2; rank <= Rank7; rank++ {
+				sq := rank*8 + file
+				if leadPawnsCnt == 1 {
+					tbMapPawns[sq] = availableSquares
+					availableSquares--
+					tbMapPawns[sq^7] = availableSquares
+					availableSquares--
+				}
+				tbLeadPawnIdx[leadPawnsCnt][sq] = idx
+				idx += tbBinomial[leadPawnsCnt-1][tbMapPawns[sq]]
+			}
+			tbLeadPawnsSize[leadPawnsCnt][file] = idx
+		}
+	}
+}
+
+// Look for Syzygy tablebase files in the given list of directories, separated the
+// same way as the PATH environment variable. Any tablebases found before are
+// forgotten, and their files unmapped. Returns the number of WDL tables found.
+func InitSyzygy(paths string) int {
+	for key, entry := range tablebases.entries {
+		if key == entry.wdl.key {
+			entry.wdl.unload()
+			if entry.dtz != nil {
+				entry.dtz.unload()
+			}
+		}
+	}
+	tablebases.entries = map[string]*tbEntry{}
+	tablebases.largest = 0
+
+	if paths == "" || paths == "<empty>" {
+		return 0
+	}
+
+	found := 0
+	for _, dir := range filepath.SplitList(paths) {
+		files, err := os.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+
+		for _, file := range files {
+			code, isWDL := strings.CutSuffix(file.Name(), ".rtbw")
+			if !isWDL || !isValidTBCode(code) {
+				continue
+			}
+
+			key, key2 := code, swapTBCode(code)
+			if _, ok := tablebases.entries[key]; ok {
+				continue
+			}
+
+			entry := &tbEntry{wdl: newTBTable(filepath.Join(dir, file.Name()), code, false)}
+			dtzPath := filepath.Join(dir, code+".rtbz")
+			if _, err := os.Stat(dtzPath); err == nil {
+				entry.dtz = newTBTable(dtzPath, code, true)
+			}
+
+			tablebases.entries[key] = entry
+			tablebases.entries[key2] = entry
+			tablebases.largest = max(tablebases.largest, entry.wdl.pieceCount)
+			found++
+		}
+	}
+
+	// DTZ files may be kept in a different directory than their WDL files.
+	for _, dir := range filepath.SplitList(paths) {
+		for key, entry := range tablebases.entries {
+			if entry.dtz != nil || key != entry.wdl.key {
+				continue
+			}
+			dtzPath := filepath.Join(dir, key+".rtbz")
+			if _, err := os.Stat(dtzPath); err == nil {
+				entry.dtz = newTBTable(dtzPath, key, true)
+			}
+		}
+	}
+
+	return found
+}
+
+// Get the largest number of pieces, kings included, of any tablebase found.
+func SyzygyLargest() int {
+	return tablebases.largest
+}
+
+func isValidTBCode(code string) bool {
+	sides := strings.Split(code, "v")
+	if len(sides) != 2 || len(code)-1 > TBMaxPieces {
+		return false
+	}
+
+	for _, side := range sides {
+		if len(side) == 0 || side[0] != 'K' || strings.Count(side, "K") != 1 {
+			return false
+		}
+		if strings.Trim(side, "KQRBNP") != "" {
+			return false
+		}
+	}
+	return true
+}
+
+func swapTBCode(code string) string {
+	sides := strings.Split(code, "v")
+	return sides[1] + "v" + sides[0]
+}
+
+func newTBTable(path, code string, isDTZ bool) *tbTable {
+	table := &tbTable{path: path, isDTZ: isDTZ, key: code, key2: swapTBCode(code)}
+
+	sides := strings.Split(code, "v")
+	var pawns [2]int
+	for color, side := range sides {
+		for _, piece := range "QRBNP" {
+			count := strings.Count(side, string(piece))
+			if count == 1 {
+				table.hasUniquePieces = true
+			}
+		}
+		pawns[color] = strings.Count(side, "P")
+		table.pieceCount += len(side)
+	}
+
+	table.hasPawns = pawns[White]+pawns[Black] > 0
+
+	// The leading color is the side with fewer pawns, since it compresses better.
+	leadColor := Black
+	if pawns[Black] == 0 || (pawns[White] > 0 && pawns[Black] >= pawns[White]) {
+		leadColor = White
+	}
+	table.pawnCount[0] = pawns[leadColor]
+	table.pawnCount[1] = pawns[leadColor^1]
+
+	return table
+}
+
+// Map the table's file into memory, and parse its header, the first time the table's
+// used. The file isn't read up front, so this doesn't stall the search, and only the
+// parts of it which are probed are ever read. Returns false if the file couldn't be
+// mapped or isn't a valid tablebase file.
+func (t *tbTable) load() bool {
+	t.loadOnce.Do(func() {
+		data, err := mapFile(t.path)
+		if err != nil {
+			return
+		}
+
+		magic := tbWDLMagic
+		if t.isDTZ {
+			magic = tbDTZMagic
+		}
+		if len(data)%64 != 16 || [4]byte(data[:4]) != magic {
+			unmapFile(data)
+			return
+		}
+
+		t.data = data
+		t.setup()
+		t.loaded = true
+	})
+	return t.loaded
+}
+
+func (t *tbTable) unload() {
+	if t.loaded {
+		unmapFile(t.data)
+		t.data = nil
+		t.loaded = false
+	}
+}
+
+func (t *tbTable) sides() int {
+	if !t.isDTZ && t.key != t.key2 {
+		return 2
+	}
+	return 1
+}
+
+func (t *tbTable) get(stm int, file uint8) *tbPairsData {
+	if !t.hasPawns {
+		file = 0
+	}
+	return &t.items[stm%t.sides()][file]
+}
+
+func (t *tbTable) setup() {
+	data := t.data
+	p := 5 // Skip the magic bytes and the flags.
+
+	sides := t.sides()
+	maxFile := FileA
+	if t.hasPawns {
+		maxFile = FileD
+	}
+
+	// Whether both sides have pawns.
+	pp := t.hasPawns && t.pawnCount[1] > 0
+
+	for file := FileA; file <= maxFile; file++ {
+		order := [2][2]int{{int(data[p] & 0xf), 0xf}, {int(data[p] >> 4), 0xf}}
+		if pp {
+			order[0][1] = int(data[p+1] & 0xf)
+			order[1][1] = int(data[p+1] >> 4)
+			p++
+		}
+		p++
+
+		for k := 0; k < t.pieceCount; k++ {
+			t.items[0][file].pieces[k] = data[p] & 0xf
+			t.items[1][file].pieces[k] = data[p] >> 4
+			p++
+		}
+
+		for i := 0; i < sides; i++ {
+			t.setGroups(&t.items[i][file], order[i], file)
+		}
+	}
+
+	p += p & 1
+
+	for file := FileA; file <= maxFile; file++ {
+		for i := 0; i < sides; i++ {
+			p = t.setSizes(&t.items[i][file], p)
+		}
+	}
+
+	if t.isDTZ {
+		p = t.setDTZMap(p, maxFile)
+	}
+
+	for file := FileA; file <= maxFile; file++ {
+		for i := 0; i < sides; i++ {
+			d := &t.items[i][file]
+			d.sparseIndex = p
+			p += int(d.sparseIndexSize) * 6
+		}
+	}
+
+	for file := FileA; file <= maxFile; file++ {
+		for i := 0; i < sides; i++ {
+			d := &t.items[i][file]
+			d.blockLength = p
+			p += int(d.blockLengthSize) * 2
+		}
+	}
+
+	for file := FileA; file <= maxFile; file++ {
+		for i := 0; i < sides; i++ {
+			d := &t.items[i][file]
+			p = (p + 0x3f) &^ 0x3f
+			d.blocks = p
+			p += int(d.numBlocks * d.sizeofBlock)
+		}
+	}
+}
+
+// Split the pieces of the table into groups, which are encoded one after the other.
+// The first group is made of the leading pawns, or of the kings and any other unique
+// piece, and every later group of pieces of the same kind.
+func (t *tbTable) setGroups(d *tbPairsData, order [2]int, file uint8) {
+	n := 0
+	firstLen := 2
+	if t.hasPawns {
+		firstLen = 0
+	} else if t.hasUniquePieces {
+		firstLen = 3
+	}
+
+	d.groupLen[n] = 1
+	for i := 1; i < t.pieceCount; i++ {
+		firstLen--
+		if firstLen > 0 || d.pieces[i] == d.pieces[i-1] {
+			d.groupLen[n]++
+		} else {
+			n++
+			d.groupLen[n] = 1
+		}
+	}
+	n++
+	d.groupLen[n] = 0
+
+	// The order the groups are encoded in is a parameter of each table. The leading
+	// group is at order[0], and the remaining pawns, when both sides have pawns, at
+	// order[1].
+	pp := t.hasPawns && t.pawnCount[1] > 0
+	next := 1
+	freeSquares := 64 - d.groupLen[0]
+	if pp {
+		next = 2
+		freeSquares -= d.groupLen[1]
+	}
+
+	idx := uint64(1)
+	for k := 0; next < n || k == order[0] || k == order[1]; k++ {
+		if k == order[0] {
+			d.groupIdx[0] = idx
+			if t.hasPawns {
+				idx *= tbLeadPawnsSize[d.groupLen[0]][file]
+			} else if t.hasUniquePieces {
+				idx *= 31332
+			} else {
+				idx *= 462
+			}
+		} else if k == order[1] {
+			d.groupIdx[1] = idx
+			idx *= tbBinomial[d.groupLen[1]][48-d.groupLen[0]]
+		} else {
+			d.groupIdx[next] = idx
+			idx *= tbBinomial[d.groupLen[next]][freeSquares]
+			freeSquares -= d.groupLen[next]
+			next++
+		}
+	}
+
+	d.groupIdx[n] = idx
+}
+
+func (t *tbTable) setSizes(d *tbPairsData, p int) int {
+	data := t.data
+	d.flags = data[p]
+	p++
+
+	if d.flags&tbFlagSingleValue != 0 {
+		// The single value every position in the table has is stored
+		// in place of the minimum symbol length.
+		d.minSymLen = int(data[p])
+		return p + 1
+	}
+
+	n := 0
+	for d.groupLen[n] != 0 {
+		n++
+	}
+	tbSize := d.groupIdx[n]
+
+	d.sizeofBlock = 1 << data[p]
+	d.span = 1 << data[p+1]
+	d.sparseIndexSize = (tbSize + d.span - 1) / d.span
+	padding := uint64(data[p+2])
+	d.numBlocks = uint64(binary.LittleEndian.Uint32(data[p+3:]))
+	d.blockLengthSize = d.numBlocks + padding
+	d.maxSymLen = int(data[p+7])
+	d.minSymLen = int(data[p+8])
+	p += 9
+
+	d.lowestSym = p
+	d.base64 = make([]uint64, d.maxSymLen-d.minSymLen+1)
+
+	// Symbols of a canonical Huffman code are ordered so longer symbols have lower
+	// values. Compute the lowest value, left aligned in 64 bits, of a symbol of each
+	// length, so the length of the next symbol can be found by comparing against them.
+	for i := len(d.base64) - 2; i >= 0; i-- {
+		d.base64[i] = (d.base64[i+1] + uint64(t.lowestSym(d, i)) - uint64(t.lowestSym(d, i+1))) / 2
+	}
+	for i := range d.base64 {
+		d.base64[i] <<= 64 - i - d.minSymLen
+	}
+
+	p += len(d.base64) * 2
+	numSyms := int(binary.LittleEndian.Uint16(data[p:]))
+	p += 2
+	d.btree = p
+	d.symlen = make([]uint8, numSyms)
+
+	// The data is compressed with recursive pairing, which repeatedly replaces the
+	// most frequent pair of adjacent symbols with a new symbol. Work out how many
+	// values each symbol expands to.
+	visited := make([]bool, numSyms)
+	for sym := 0; sym < numSyms; sym++ {
+		if !visited[sym] {
+			d.symlen[sym] = t.setSymLen(d, sym, visited)
+		}
+	}
+
+	return p + numSyms*3 + numSyms&1
+}
+
+func (t *tbTable) setSymLen(d *tbPairsData, sym int, visited []bool) uint8 {
+	visited[sym] = true
+	right := t.btreeRight(d, sym)
+	if right == 0xfff {
+		return 0
+	}
+
+	left := t.btreeLeft(d, sym)
+	if !visited[left] {
+		d.symlen[left] = t.setSymLen(d, left, visited)
+	}
+	if !visited[right] {
+		d.symlen[right] = t.setSymLen(d, right, visited)
+	}
+
+	return d.symlen[left] + d.symlen[right] + 1
+}
+
+// DTZ tables may store their values through a map, to make them compress better.
+func (t *tbTable) setDTZMap(p int, maxFile uint8) int {
+	data := t.data
+	t.dtzMap = p
+
+	for file := FileA; file <= maxFile; file++ {
+		d := &t.items[0][file]
+		if d.flags&tbFlagMapped == 0 {
+			continue
+		}
+
+		if d.flags&tbFlagWide != 0 {
+			p += p & 1
+			for i := 0; i < 4; i++ {
+				d.mapIdx[i] = uint16((p-t.dtzMap)/2 + 1)
+				p += 2*int(binary.LittleEndian.Uint16(data[p:])) + 2
+			}
+		} else {
+			for i := 0; i < 4; i++ {
+				d.mapIdx[i] = uint16(p - t.dtzMap + 1)
+				p += int(data[p]) + 1
+			}
+		}
+	}
+
+	return p + p&1
+}
+
+func (t *tbTable) lowestSym(d *tbPairsData, length int) uint16 {
+	return binary.LittleEndian.Uint16(t.data[d.lowestSym+length*2:])
+}
+
+func (t *tbTable) btreeLeft(d *tbPairsData, sym int) int {
+	node := t.data[d.btree+sym*3:]
+	return int(node[1]&0xf)<<8 | int(node[0])
+}
+
+func (t *tbTable) btreeRight(d *tbPairsData, sym int) int {
+	node := t.data[d.btree+sym*3:]
+	return int(node[2])<<4 | int(node[1]>>4)
+}
+
+func (t *tbTable) blockLength(d *tbPairsData, block uint32) int {
+	return int(binary.LittleEndian.Uint16(t.data[d.blockLength+int(block)*2:]))
+}
+
+// Read a big endian 32 bit integer, treating bytes past the end of the file as zero,
+// since the last block of a table can be shorter than the bits read ahead from it.
+func (t *tbTable) readUint32BE(p int) uint32 {
+	if p+4 <= len(t.data) {
+		return binary.BigEndian.Uint32(t.data[p:])
+	}
+
+	value := uint32(0)
+	for i := 0; i < 4; i++ {
+		value <<= 8
+		if p+i < len(t.data) {
+			value |= uint32(t.data[p+i])
+		}
+	}
+	return value
+}
+
+// Get the value stored at the given index of a table.
+func (t *tbTable) decompress(d *tbPairsData, idx uint64) int {
+	if d.flags&tbFlagSingleValue != 0 {
+		return d.minSymLen
+	}
+
+	// Every span values, the sparse index stores which block holds the value,
+	// and where in the block it is. Start from the nearest entry, and walk to
+	// the block holding the value.
+	k := idx / d.span
+	entry := d.sparseIndex + int(k)*6
+	block := binary.LittleEndian.Uint32(t.data[entry:])
+	offset := int(binary.LittleEndian.Uint16(t.data[entry+4:]))
+	offset += int(idx%d.span) - int(d.span/2)
+
+	for offset < 0 {
+		block--
+		offset += t.blockLength(d, block) + 1
+	}
+	for offset > t.blockLength(d, block) {
+		offset -= t.blockLength(d, block) + 1
+		block++
+	}
+
+	// Decode the block's symbols one by one, until reaching the symbol which
+	// expands into the run of values containing the one we're looking for.
+	p := d.blocks + int(block)*int(d.sizeofBlock)
+	buf64 := uint64(t.readUint32BE(p))<<32 | uint64(t.readUint32BE(p+4))
+	p += 8
+	buf64Size := 64
+	sym := 0
+
+	for {
+		length := 0
+		for buf64 < d.base64[length] {
+			length++
+		}
+
+		sym = int((buf64 - d.base64[length]) >> (64 - length - d.minSymLen))
+		sym += int(t.lowestSym(d, length))
+
+		if offset < int(d.symlen[sym])+1 {
+			break
+		}
+
+		offset -= int(d.symlen[sym]) + 1
+		length += d.minSymLen
+		buf64 <<= length
+		buf64Size -= length
+
+		if buf64Size <= 32 {
+			buf64Size += 32
+			buf64 |= uint64(t.readUint32BE(p)) << (64 - buf64Size)
+			p += 4
+		}
+	}
+
+	// Expand the symbol into the pair of symbols it replaced, until reaching
+	// the single value we're looking for.
+	for d.symlen[sym] != 0 {
+		left := t.btreeLeft(d, sym)
+		if offset < int(d.symlen[left])+1 {
+			sym = left
+		} else {
+			offset -= int(d.symlen[left]) + 1
+			sym = t.btreeRight(d, sym)
+		}
+	}
+
+	return t.btreeLeft(d, sym)
+}
+
+// DTZ tables only store the positions of one side to move, unless both sides
+// have the same pieces, and there are no pawns.
+func (t *tbTable) checkDTZStm(stm int, file uint8) bool {
+	flags := t.get(stm, file).flags
+	return int(flags&tbFlagSTM) == stm || (t.key == t.key2 && !t.hasPawns)
+}
+
+// Convert a value stored in the table into a WDL score, or a DTZ score in plies.
+func (t *tbTable) mapScore(file uint8, value, wdl int) int {
+	if !t.isDTZ {
+		return value - 2
+	}
+
+	wdlMap := [5]int{1, 3, 0, 2, 0}
+	d := t.get(0, file)
+
+	if d.flags&tbFlagMapped != 0 {
+		idx := int(d.mapIdx[wdlMap[wdl+2]]) + value
+		if d.flags&tbFlagWide != 0 {
+			value = int(binary.LittleEndian.Uint16(t.data[t.dtzMap+idx*2:]))
+		} else {
+			value = int(t.data[t.dtzMap+idx])
+		}
+	}
+
+	if (wdl == WDLWin && d.flags&tbFlagWinPlies == 0) ||
+		(wdl == WDLLoss && d.flags&tbFlagLossPlies == 0) ||
+		wdl == WDLCursedWin || wdl == WDLBlessedLoss {
+		value *= 2
+	}
+
+	return value + 1
+}
+
+// Look up the position in the table. The position must have the table's material.
+func (t *tbTable) probe(pos *Position, wdl int) (int, int) {
+	d, idx, tbFile, state := t.index(pos)
+	if state != tbProbeOK {
+		return 0, state
+	}
+	return t.mapScore(tbFile, t.decompress(d, idx), wdl), tbProbeOK
+}
+
+// Compute the index of the position in the table, along with the part of the table
+// it's stored in, and the file of the leading pawn.
+func (t *tbTable) index(pos *Position) (*tbPairsData, uint64, uint8, int) {
+	var squares [TBMaxPieces]uint8
+	var pieces [TBMaxPieces]uint8
+	size, leadPawnsCnt := 0, 0
+	leadPawns := uint64(0)
+	tbFile := FileA
+
+	// Tables are stored with white as the stronger side, and only with white to move
+	// when both sides have the same pieces. Otherwise the colors are switched and the
+	// board flipped before the lookup.
+	symmetricBlackToMove := t.key == t.key2 && pos.Side == Black
+	blackStronger := tbMaterialKey(pos) != t.key
+	flipColor, flipSquares := uint8(0), uint8(0)
+	stm := int(pos.Side)
+	if symmetricBlackToMove || blackStronger {
+		flipColor, flipSquares = 8, 56
+		stm ^= 1
+	}
+
+	// Positions with pawns are stored in a table for each file of the leading pawn.
+	if t.hasPawns {
+		leadColor := (t.get(0, 0).pieces[0] ^ flipColor) >> 3
+		leadPawns = pos.Pieces[Pawn] & pos.Colors[leadColor]
+		for bb := leadPawns; bb != 0; bb &= bb - 1 {
+			squares[size] = GetLSBpos(bb) ^ flipSquares
+			size++
+		}
+		leadPawnsCnt = size
+
+		leadIdx := 0
+		for i := 1; i < leadPawnsCnt; i++ {
+			if tbMapPawns[squares[i]] > tbMapPawns[squares[leadIdx]] {
+				leadIdx = i
+			}
+		}
+		squares[0], squares[leadIdx] = squares[leadIdx], squares[0]
+
+		tbFile = FileOf(squares[0])
+		if tbFile > FileD {
+			tbFile = FileOf(squares[0] ^ 7)
+		}
+	}
+
+	if t.isDTZ && !t.checkDTZStm(stm, tbFile) {
+		return nil, 0, tbFile, tbProbeChangeSTM
+	}
+
+	for bb := (pos.Colors[White] | pos.Colors[Black]) ^ leadPawns; bb != 0; bb &= bb - 1 {
+		sq := GetLSBpos(bb)
+		squares[size] = sq ^ flipSquares
+		pieces[size] = tbPiece(pos, sq) ^ flipColor
+		size++
+	}
+
+	d := t.get(stm, tbFile)
+
+	// Put the pieces in the same order as the table stores them.
+	for i := leadPawnsCnt; i < size-1; i++ {
+		for j := i + 1; j < size; j++ {
+			if d.pieces[i] == pieces[j] {
+				pieces[i], pieces[j] = pieces[j], pieces[i]
+				squares[i], squares[j] = squares[j], squares[i]
+				break
+			}
+		}
+	}
+
+	// Mirror the board so the leading piece is on files a-d.
+	if FileOf(squares[0]) > FileD {
+		for i := 0; i < size; i++ {
+			squares[i] ^= 7
+		}
+	}
+
+	idx := uint64(0)
+	if t.hasPawns {
+		idx = tbLeadPawnIdx[leadPawnsCnt][squares[0]]
+		sortSquares(squares[1:leadPawnsCnt], func(sq uint8) int { return tbMapPawns[sq] })
+		for i := 1; i < leadPawnsCnt; i++ {
+			idx += tbBinomial[i][tbMapPawns[squares[i]]]
+		}
+	} else {
+		// Without pawns the board can also be flipped vertically and along the
+		// a1-h8 diagonal, to put the leading piece in the a1-d1-d4 triangle.
+		if RankOf(squares[0]) > Rank4 {
+			for i := 0; i < size; i++ {
+				squares[i] ^= 56
+			}
+		}
+
+		for i := 0; i < d.groupLen[0]; i++ {
+			if offA1H8(squares[i]) == 0 {
+				continue
+			}
+			if offA1H8(squares[i]) > 0 {
+				for j := i; j < size; j++ {
+					squares[j] = ((squares[j] >> 3) | (squares[j] << 3)) & 63
+				}
+			}
+			break
+		}
+
+		idx = encodeLeadingPieces(t, squares[:])
+	}
+
+	// Encode the remaining groups, mapping each square down past the squares
+	// taken by the earlier groups.
+	idx *= d.groupIdx[0]
+	groupStart := d.groupLen[0]
+	remainingPawns := t.hasPawns && t.pawnCount[1] > 0
+
+	for next := 1; d.groupLen[next] != 0; next++ {
+		group := squares[groupStart : groupStart+d.groupLen[next]]
+		sortSquares(group, func(sq uint8) int { return int(sq) })
+
+		n := uint64(0)
+		for i, sq := range group {
+			adjust := 0
+			for _, prevSq := range squares[:groupStart] {
+				if sq > prevSq {
+					adjust++
+				}
+			}
+
+			mappedSq := int(sq) - adjust
+			if remainingPawns {
+				mappedSq -= 8
+			}
+			n += tbBinomial[i+1][mappedSq]
+		}
+
+		remainingPawns = false
+		idx += n * d.groupIdx[next]
+		groupStart += d.groupLen[next]
+	}
+
+	return d, idx, tbFile, tbProbeOK
+}
+
+// Encode the leading group of a table without pawns, which is either the two kings
+// and a third unique piece, or just the two kings.
+func encodeLeadingPieces(t *tbTable, squares []uint8) uint64 {
+	if !t.hasUniquePieces {
+		return tbMapKK[tbMapA1D1D4[squares[0]]][squares[1]]
+	}
+
+	sq0, sq1, sq2 := int(squares[0]), int(squares[1]), int(squares[2])
+	adjust1 := 0
+	if sq1 > sq0 {
+		adjust1 = 1
+	}
+	adjust2 := 0
+	if sq2 > sq0 {
+		adjust2++
+	}
+	if sq2 > sq1 {
+		adjust2++
+	}
+
+	rank0, rank1, rank2 := int(RankOf(squares[0])), int(RankOf(squares[1])), int(RankOf(squares[2]))
+
+	var idx int
+	if offA1H8(squares[0]) != 0 {
+		idx = (tbMapA1D1D4[sq0]*63+(sq1-adjust1))*62 + sq2 - adjust2
+	} else if offA1H8(squares[1]) != 0 {
+		idx = (6*63+rank0*28+tbMapB1H1H7[sq1])*62 + sq2 - adjust2
+	} else if offA1H8(squares[2]) != 0 {
+		idx = 6*63*62 + 4*28*62 + rank0*7*28 + (rank1-adjust1)*28 + tbMapB1H1H7[sq2]
+	} else {
+		idx = 6*63*62 + 4*28*62 + 4*7*28 + rank0*7*6 + (rank1-adjust1)*6 + (rank2 - adjust2)
+	}
+	return uint64(idx)
+}
+
+// Stable insertion sort of a few squares by the given key.
+func sortSquares(squares []uint8, key func(uint8) int) {
+	for i := 1; i < len(squares); i++ {
+		for j := i; j > 0 && key(squares[j]) < key(squares[j-1]); j-- {
+			squares[j], squares[j-1] = squares[j-1], squares[j]
+		}
+	}
+}
+
+func offA1H8(sq uint8) int {
+	return int(RankOf(sq)) - int(FileOf(sq))
+}
+
+// Get the piece on the square as encoded in tablebase files: the piece type
+// from 1 (pawn) to 6 (king), plus 8 for black pieces.
+func tbPiece(pos *Position, sq uint8) uint8 {
+	return (pos.GetPieceTypeOnSq(sq) + 1) | pos.GetPieceColorOnSq(sq)<<3
+}
+
+// Get the material of the position the way tablebase files are named, with
+// white's pieces first, e.g. KRPvKR.
+func tbMaterialKey(pos *Position) string {
+	var sb strings.Builder
+	for color := uint8(White); color <= Black; color++ {
+		if color == Black {
+			sb.WriteByte('v')
+		}
+		for pieceType := int(King); pieceType >= Pawn; pieceType-- {
+			count := CountBits(pos.Pieces[pieceType] & pos.Colors[color])
+			for i := int16(0); i < count; i++ {
+				sb.WriteByte("PNBRQK"[pieceType])
+			}
+		}
+	}
+	return sb.String()
+}
+
+func tbPieceCount(pos *Position) int {
+	return int(CountBits(pos.Colors[White] | pos.Colors[Black]))
+}
+
+func probeTable(pos *Position, isDTZ bool, wdl int) (int, int) {
+	if tbPieceCount(pos) == 2 {
+		return WDLDraw, tbProbeOK
+	}
+
+	entry := tablebases.entries[tbMaterialKey(pos)]
+	if entry == nil {
+		return 0, tbProbeFail
+	}
+
+	table := entry.wdl
+	if isDTZ {
+		table = entry.dtz
+	}
+
+	if table == nil || !table.load() {
+		return 0, tbProbeFail
+	}
+	return table.probe(pos, wdl)
+}
+
+// Get the WDL score of the position by first trying every capture (and every pawn move,
+// when checkZeroingMoves is set), since the tables don't store any position where the
+// best move is a capture, or where there's a possible en passant capture.
+func tbSearch(pos *Position, checkZeroingMoves bool) (int, int) {
+	bestValue := WDLLoss
+	totalCount, moveCount := 0, 0
+
+	var child Position
+	for _, move := range genMoves(pos) {
+		CopyPos(pos, &child)
+		child.DoMove(move)
+		if child.IsSideInCheck(child.Side ^ 1) {
+			continue
+		}
+		totalCount++
+
+		if !move.IsCapture() && (!checkZeroingMoves || move.FromType() != Pawn) {
+			continue
+		}
+		moveCount++
+
+		value, state := tbSearch(&child, false)
+		value = -value
+		if state == tbProbeFail {
+			return WDLDraw, tbProbeFail
+		}
+
+		if value > bestValue {
+			bestValue = value
+			if value >= WDLWin {
+				return value, tbProbeZeroingBestMove
+			}
+		}
+	}
+
+	// If every legal move was already searched, the table doesn't need to be
+	// probed, which matters since its value could be wrong for the position.
+	noMoreMoves := moveCount > 0 && moveCount == totalCount
+
+	value := bestValue
+	if !noMoreMoves {
+		var state int
+		value, state = probeTable(pos, false, WDLDraw)
+		if state == tbProbeFail {
+			return WDLDraw, tbProbeFail
+		}
+	}
+
+	// The table stores a "don't care" value if the best move is a capture
+	// which wins.
+	if bestValue >= value {
+		if bestValue > WDLDraw || noMoreMoves {
+			return bestValue, tbProbeZeroingBestMove
+		}
+		return bestValue, tbProbeOK
+	}
+
+	return value, tbProbeOK
+}
+
+// Probe the WDL tables for the outcome of the position with best play, from the
+// perspective of the side to move. The position shouldn't have castling rights.
+func probeWDL(pos *Position) (int, bool) {
+	wdl, state := tbSearch(pos, false)
+	return wdl, state != tbProbeFail
+}
+
+// Probe the DTZ tables for the number of plies until the next zeroing move, with best
+// play, from the perspective of the side to move. The sign of the score is the sign of
+// the WDL score, and cursed wins and blessed losses are offset by 100.
+func probeDTZ(pos *Position) (int, bool) {
+	wdl, state := tbSearch(pos, true)
+	if state == tbProbeFail {
+		return 0, false
+	}
+
+	if wdl == WDLDraw {
+		return 0, true
+	}
+
+	// The best move zeroes the counter, so the table can't be trusted.
+	if state == tbProbeZeroingBestMove {
+		return dtzBeforeZeroing(wdl), true
+	}
+
+	dtz, state := probeTable(pos, true, wdl)
+	if state == tbProbeFail {
+		return 0, false
+	}
+
+	if state != tbProbeChangeSTM {
+		if wdl == WDLBlessedLoss || wdl == WDLCursedWin {
+			dtz += 100
+		}
+		if wdl < 0 {
+			return -dtz, true
+		}
+		return dtz, true
+	}
+
+	// The table only stores the other side to move, so search every move
+	// for the one which best keeps the outcome.
+	minDTZ := 0xffff
+	var child Position
+	for _, move := range genMoves(pos) {
+		CopyPos(pos, &child)
+		child.DoMove(move)
+		if child.IsSideInCheck(child.Side ^ 1) {
+			continue
+		}
+
+		zeroing := move.IsCapture() || move.FromType() == Pawn
+		ok := true
+
+		// For a zeroing move, the DTZ is that of the move itself, rather than of
+		// the position after it. The WDL score of the position after the move is
+		// still needed to know which side the move leaves ahead.
+		if zeroing {
+			childWDL, childOK := probeWDL(&child)
+			dtz, ok = -dtzBeforeZeroing(childWDL), childOK
+		} else {
+			dtz, ok = probeDTZ(&child)
+			dtz = -dtz
+		}
+
+		if !ok {
+			return 0, false
+		}
+
+		if dtz == 1 && child.IsSideInCheck(child.Side) && !hasLegalMoves(&child) {
+			minDTZ = 1
+		}
+
+		if !zeroing {
+			dtz += sign(dtz)
+		}
+
+		if dtz < minDTZ && sign(dtz) == sign(wdl) {
+			minDTZ = dtz
+		}
+	}
+
+	// With no legal moves, the side to move has been checkmated.
+	if minDTZ == 0xffff {
+		return -1, true
+	}
+	return minDTZ, true
+}
+
+func dtzBeforeZeroing(wdl int) int {
+	switch wdl {
+	case WDLWin:
+		return 1
+	case WDLCursedWin:
+		return 101
+	case WDLBlessedLoss:
+		return -101
+	case WDLLoss:
+		return -1
+	}
+	return 0
+}
+
+func sign(value int) int {
+	if value > 0 {
+		return 1
+	} else if value < 0 {
+		return -1
+	}
+	return 0
+}
+
+func hasLegalMoves(pos *Position) bool {
+	var child Position
+	for _, move := range genMoves(pos) {
+		CopyPos(pos, &child)
+		child.DoMove(move)
+		if !child.IsSideInCheck(child.Side ^ 1) {
+			return true
+		}
+	}
+	return false
+}
+
+// Convert a WDL score into a search score, and the kind of bound it is. Cursed wins
+// and blessed losses are draws under the fifty move rule.
+func tbScore(wdl int, ply uint8) (int16, uint8) {
+	switch {
+	case wdl >= WDLWin:
+		return TBWinScore - int16(ply), LowerBoundFlag
+	case wdl <= WDLLoss:
+		return -TBWinScore + int16(ply), UpperBoundFlag
+	}
+	return DrawCPValue, ExactFlag
+}
+
+// Rank the legal root moves using the tablebases, and return the ones which best
+// keep the outcome of the position. The DTZ tables are used when available, which
+// also makes sure a win is converted within the fifty move rule. Otherwise the WDL
+// tables are used. Returns nil if the position couldn't be probed.
+func rankRootMovesWithTB(pos *Position, moves []Move) ([]Move, bool) {
+	if ranked := rankRootMoves(pos, moves, true); ranked != nil {
+		return ranked, true
+	}
+	return rankRootMoves(pos, moves, false), false
+}
+
+func rankRootMoves(pos *Position, moves []Move, useDTZ bool) []Move {
+	bestRank := -tbMaxDTZ - 1
+	ranks := make([]int, len(moves))
+	legalMoves := make([]Move, 0, len(moves))
+
+	var child Position
+	for _, move := range moves {
+		CopyPos(pos, &child)
+		child.DoMove(move)
+		if child.IsSideInCheck(child.Side ^ 1) {
+			continue
+		}
+
+		rank, ok := 0, false
+		if useDTZ {
+			rank, ok = rankRootMoveWithDTZ(pos, &child)
+		} else {
+			var wdl int
+			wdl, ok = probeWDL(&child)
+			rank = [5]int{-tbMaxDTZ, -tbMaxDTZ + 101, 0, tbMaxDTZ - 101, tbMaxDTZ}[-wdl+2]
+		}
+
+		if !ok {
+			return nil
+		}
+
+		ranks[len(legalMoves)] = rank
+		legalMoves = append(legalMoves, move)
+		bestRank = max(bestRank, rank)
+	}
+
+	bestMoves := make([]Move, 0, len(legalMoves))
+	for i, move := range legalMoves {
+		if ranks[i] == bestRank {
+			bestMoves = append(bestMoves, move)
+		}
+	}
+	return bestMoves
+}
+
+// Rank a root move by the DTZ of the position after it. Every move winning within
+// the fifty move rule is ranked the same, while other wins are ranked by how close
+// they come to it, and losses by how long they can hold out.
+func rankRootMoveWithDTZ(root, child *Position) (int, bool) {
+	var dtz int
+	if child.HalfMove == 0 {
+		wdl, ok := probeWDL(child)
+		if !ok {
+			return 0, false
+		}
+		dtz = dtzBeforeZeroing(-wdl)
+	} else {
+		childDTZ, ok := probeDTZ(child)
+		if !ok {
+			return 0, false
+		}
+		dtz = -childDTZ
+		dtz += sign(dtz)
+	}
+
+	// Make sure a mating move is given a DTZ of one.
+	if child.IsSideInCheck(child.Side) && dtz == 2 && !hasLegalMoves(child) {
+		dtz = 1
+	}
+
+	halfMove := int(root.HalfMove)
+	switch {
+	case dtz > 0:
+		if dtz+halfMove <= 99 {
+			return tbMaxDTZ, true
+		}
+		return tbMaxDTZ - (dtz + halfMove), true
+	case dtz < 0:
+		if -dtz*2+halfMove < 100 {
+			return -tbMaxDTZ, true
+		}
+		return -tbMaxDTZ + (-dtz + halfMove), true
+	}
+	return 0, true
+}
@@ -0,0 +1,177 @@
+package engine
+
+import (
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Syzygy tables aren't kept in the repository. To run these tests, generate the tables
+// below (e.g. with https://github.com/syzygy1/tb), and either put them in testdata/syzygy
+// or point EQUES_SYZYGY_PATH at them. The tests are skipped when any are missing.
+var syzygyTestTables = []string{
+	"KQvK", "KRvK", "KBvK", "KNvK", "KPvK",
+	"KRvKP", "KQvKR", "KRvKR", "KRvKB", "KRvKN",
+}
+
+func TestMain(m *testing.M) {
+	InitTables()
+	InitZobristValues()
+	os.Exit(m.Run())
+}
+
+func initSyzygyTestTables(t *testing.T) {
+	path := os.Getenv("EQUES_SYZYGY_PATH")
+	if path == "" {
+		path = filepath.Join("testdata", "syzygy")
+	}
+
+	InitSyzygy(path)
+	t.Cleanup(func() { InitSyzygy("") })
+
+	for _, key := range syzygyTestTables {
+		entry, ok := tablebases.entries[key]
+		if !ok || entry.dtz == nil {
+			t.Skipf("missing the %s WDL or DTZ table in %s", key, path)
+		}
+	}
+}
+
+func TestSyzygyKnownPositions(t *testing.T) {
+	initSyzygyTestTables(t)
+
+	tests := []struct {
+		fen string
+		wdl int
+		// The expected DTZ, or zero if it's only checked to have the sign of the WDL.
+		dtz int
+	}{
+		{"8/8/8/4k3/8/8/8/R3K3 w - - 0 1", WDLWin, 0},
+		{"8/8/8/8/8/8/1k6/R3K3 b - - 0 1", WDLDraw, 0},
+		{"6k1/8/6K1/8/8/8/8/R7 w - - 0 1", WDLWin, 1},
+		{"R5k1/8/6K1/8/8/8/8/8 b - - 0 1", WDLLoss, -1},
+		{"7k/8/8/8/8/8/7P/7K w - - 0 1", WDLDraw, 0},
+		{"4k3/8/4K3/4P3/8/8/8/8 w - - 0 1", WDLWin, 0},
+		{"4k3/8/4K3/4P3/8/8/8/8 b - - 0 1", WDLLoss, 0},
+		{"8/8/8/8/8/1k6/p7/2K4R w - - 0 1", WDLWin, 0},
+		{"8/8/8/8/8/5K2/p7/1k5R w - - 0 1", WDLDraw, 0},
+	}
+
+	for _, test := range tests {
+		var pos Position
+		pos.LoadFEN(test.fen)
+
+		wdl, ok := probeWDL(&pos)
+		if !ok || wdl != test.wdl {
+			t.Errorf("%s: expected WDL %d, got %d (ok=%v)", test.fen, test.wdl, wdl, ok)
+		}
+
+		dtz, ok := probeDTZ(&pos)
+		if !ok || sign(dtz) != sign(test.wdl) || (test.dtz != 0 && dtz != test.dtz) {
+			t.Errorf("%s: expected a DTZ of %d with the sign of WDL %d, got %d (ok=%v)", test.fen, test.dtz, test.wdl, dtz, ok)
+		}
+	}
+}
+
+// Check the Syzygy tables against the exact results of the retrograde DTM generator.
+// Every position of the three piece tables is probed, and a sample of the positions of
+// the four piece table. Since pawnless tables have no zeroing moves besides mate, their
+// DTZ is also compared to the distance to mate, which it can exceed by one ply since
+// the tables may round it.
+func TestSyzygyAgreesWithDTM(t *testing.T) {
+	initSyzygyTestTables(t)
+	if testing.Short() {
+		t.Skip("generating the DTM tables takes too long in short mode")
+	}
+
+	if err := GenerateDTMTablebases([]string{"KRvK", "KPvK", "KRvKP"}, t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { InitDTMTablebases("") })
+
+	rng := rand.New(rand.NewSource(1))
+	for _, test := range []struct {
+		key     string
+		samples int
+	}{
+		{"KRvK", 0},
+		{"KPvK", 0},
+		{"KRvKP", 200_000},
+	} {
+		pieces := newDTMTable(test.key).pieces
+		squares := make([]uint8, len(pieces))
+		checkPos := func(side uint8) {
+			pos, ok := syzygyTestPosition(pieces, squares, side)
+			if !ok {
+				return
+			}
+			checkSyzygyAgainstDTM(t, &pos, test.key == "KRvK")
+		}
+
+		if test.samples == 0 {
+			numPositions := 1 << (6 * len(pieces))
+			for idx := 0; idx < numPositions; idx++ {
+				for i := range squares {
+					squares[i] = uint8(idx >> (6 * i) & 63)
+				}
+				checkPos(White)
+				checkPos(Black)
+			}
+		} else {
+			for n := 0; n < test.samples; n++ {
+				for i := range squares {
+					squares[i] = uint8(rng.Intn(64))
+				}
+				checkPos(uint8(rng.Intn(2)))
+			}
+		}
+
+		if t.Failed() {
+			return
+		}
+	}
+}
+
+// Set up a position with the pieces on the given squares, or return false if it
+// isn't legal.
+func syzygyTestPosition(pieces []dtmPiece, squares []uint8, side uint8) (Position, bool) {
+	pos := Position{EPSq: NoSq, Side: side}
+	occupied := uint64(0)
+	for i, sq := range squares {
+		if IsBitset(occupied, sq) {
+			return pos, false
+		}
+		if pieces[i].pieceType == Pawn && (RankOf(sq) == Rank1 || RankOf(sq) == Rank8) {
+			return pos, false
+		}
+		occupied = SetBit(occupied, sq)
+		pos.putPiece(pieces[i].pieceType, pieces[i].color, sq)
+	}
+	return pos, !pos.IsSideInCheck(side ^ 1)
+}
+
+func checkSyzygyAgainstDTM(t *testing.T, pos *Position, compareDTZ bool) {
+	t.Helper()
+
+	dtm, ok := probeDTM(pos)
+	if !ok {
+		t.Fatalf("%s: couldn't probe the DTM tables", pos.GenFEN())
+	}
+
+	wdl, ok := probeWDL(pos)
+	if !ok || sign(wdl) != sign(int(dtm)) {
+		t.Fatalf("%s: WDL %d (ok=%v) disagrees with DTM %d", pos.GenFEN(), wdl, ok, dtm)
+	}
+
+	dtz, ok := probeDTZ(pos)
+	if !ok || sign(dtz) != sign(wdl) {
+		t.Fatalf("%s: DTZ %d (ok=%v) disagrees with WDL %d", pos.GenFEN(), dtz, ok, wdl)
+	}
+
+	// A checkmated position has a DTZ of -1, rather than zero.
+	plies, dtz := dtmPlies(dtm), dtz*sign(dtz)
+	if compareDTZ && dtm != 0 && (dtz < max(plies, 1) || dtz > plies+1) {
+		t.Fatalf("%s: DTZ %d disagrees with mate in %d plies", pos.GenFEN(), dtz, plies)
+	}
+}
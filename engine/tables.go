@@ -66,6 +66,10 @@ var KingMoves = [64]uint64{}
 var KnightMoves = [64]uint64{}
 var PawnAttacks = [2][64]uint64{}
 
+var IsolatedPawnMasks = [8]uint64{}
+var ForwardFileMasks = [2][64]uint64{}
+var PassedPawnMasks = [2][64]uint64{}
+var PawnSupportMasks = [2][64]uint64{}
 
 func InitTables() {
 	prng := prng.PseduoRandomGenerator{}
@@ -87,6 +91,42 @@ func InitTables() {
 		genRookMagicForSq(sq, &prng)
 		genBishopMagicForSq(sq, &prng)
 	}
+
+	genPawnStructureTables()
+	genSyzygyTables()
+	genDTMTables()
+}
+
+func genPawnStructureTables() {
+	for file := FileA; file <= FileH; file++ {
+		if file > FileA {
+			IsolatedPawnMasks[file] |= MaskFile[file-1]
+		}
+		if file < FileH {
+			IsolatedPawnMasks[file] |= MaskFile[file+1]
+		}
+	}
+
+	for sq := uint8(0); sq < 64; sq++ {
+		file, rank := FileOf(sq), RankOf(sq)
+		adjacentFiles := IsolatedPawnMasks[file]
+
+		for otherRank := Rank1; otherRank <= Rank8; otherRank++ {
+			if otherRank > rank {
+				ForwardFileMasks[White][sq] |= MaskFile[file] & MaskRank[otherRank]
+				PassedPawnMasks[White][sq] |= (MaskFile[file] | adjacentFiles) & MaskRank[otherRank]
+			} else {
+				PawnSupportMasks[White][sq] |= adjacentFiles & MaskRank[otherRank]
+			}
+
+			if otherRank < rank {
+				ForwardFileMasks[Black][sq] |= MaskFile[file] & MaskRank[otherRank]
+				PassedPawnMasks[Black][sq] |= (MaskFile[file] | adjacentFiles) & MaskRank[otherRank]
+			} else {
+				PawnSupportMasks[Black][sq] |= adjacentFiles & MaskRank[otherRank]
+			}
+		}
+	}
 }
 
 func genFileTables() {
@@ -0,0 +1,471 @@
+package engine
+
+import (
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Retrograde generation of distance-to-mate tablebases. Every position of a table is
+// first set up and searched one ply deep, which scores checkmates, stalemates, and
+// moves leaving the table (captures and promotions) using the smaller tables they lead
+// to. The results are then propagated backwards, ply by ply, by un-making moves: a
+// position is won if any move leads to a lost position, and lost once every move
+// leads to a won position.
+
+const (
+	dtmInvalidFlag uint8 = 1 << iota
+	dtmResolvedFlag
+)
+
+// The lowest possible score, marking a position none of whose moves
+// have been scored yet.
+const dtmUnknownScore int16 = -DTMWinScore - 1
+
+type dtmGenerator struct {
+	table  *dtmTable
+	scores []int16
+	counts []uint8
+	flags  []uint8
+
+	// The positions whose score is to be propagated, indexed by the
+	// number of plies to mate.
+	buckets [DTMMaxPlies + 2][]int
+}
+
+// Generate the tables for the given endgames, such as KRvKP, along with every table
+// they depend on, and write them into the given directory. Tables found in the
+// directory already aren't generated again.
+func GenerateDTMTablebases(keys []string, outDir string) error {
+	InitDTMTablebases(outDir)
+
+	for _, key := range keys {
+		if !isValidTBCode(key) || len(key)-1 > DTMMaxPieces {
+			return fmt.Errorf("invalid tablebase \"%s\", expected something like KRvKP with at most %d pieces", key, DTMMaxPieces)
+		}
+		if dtmHasPawnsOfBothColors(key) {
+			return fmt.Errorf("invalid tablebase \"%s\", tables with pawns of both colors aren't supported", key)
+		}
+		if _, err := generateDTMTable(key, outDir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func generateDTMTable(key, outDir string) (*dtmTable, error) {
+	if table, ok := dtmTables[key]; ok {
+		return table, nil
+	}
+	if table, ok := dtmTables[swapTBCode(key)]; ok {
+		return table, nil
+	}
+
+	// Every table a capture or promotion leads to has to be generated first.
+	for _, childKey := range dtmChildKeys(key) {
+		if len(childKey) > len("KvK") {
+			if _, err := generateDTMTable(childKey, outDir); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	start := time.Now()
+	gen := dtmGenerator{table: newDTMTable(key)}
+	if err := gen.initialize(); err != nil {
+		return nil, err
+	}
+	if err := gen.propagate(); err != nil {
+		return nil, err
+	}
+	gen.finish()
+
+	table := gen.table
+	table.path = filepath.Join(outDir, key+DTMFileExtension)
+	table.write(table.path)
+	dtmTables[key] = table
+
+	wins, losses, draws, longest := gen.stats()
+	fmt.Printf(
+		"generated %s: %d wins, %d losses, %d draws, longest mate %d plies, in %.1fs\n",
+		key, wins, losses, draws, longest, time.Since(start).Seconds(),
+	)
+
+	return table, nil
+}
+
+// Report whether both sides of the endgame have pawns. Such tables aren't supported,
+// since positions are stored without an en passant square, and one could then only
+// be given the score of the same position without the en passant capture.
+func dtmHasPawnsOfBothColors(key string) bool {
+	sides := strings.Split(key, "v")
+	return len(sides) == 2 && strings.Contains(sides[0], "P") && strings.Contains(sides[1], "P")
+}
+
+// Get the material keys of every table a capture or promotion can lead to.
+func dtmChildKeys(key string) []string {
+	sides := strings.Split(key, "v")
+	children := []string{}
+
+	addChild := func(white, black string) {
+		children = append(children, sortTBSide(white)+"v"+sortTBSide(black))
+	}
+
+	for color := 0; color < 2; color++ {
+		us, them := sides[color], sides[color^1]
+		withColors := func(us, them string) {
+			if color == 0 {
+				addChild(us, them)
+			} else {
+				addChild(them, us)
+			}
+		}
+
+		// Captures of any piece but the king.
+		for i := 1; i < len(them); i++ {
+			withColors(us, them[:i]+them[i+1:])
+		}
+
+		// Promotions, with or without capturing.
+		if pawnIdx := strings.IndexByte(us, 'P'); pawnIdx >= 0 {
+			for _, promotion := range "QRBN" {
+				promoted := us[:pawnIdx] + string(promotion) + us[pawnIdx+1:]
+				withColors(promoted, them)
+				for i := 1; i < len(them); i++ {
+					if them[i] != 'P' {
+						withColors(promoted, them[:i]+them[i+1:])
+					}
+				}
+			}
+		}
+	}
+
+	return children
+}
+
+// Order the pieces of a side the way tablebases are named: the king, then
+// queens, rooks, bishops, knights, and pawns.
+func sortTBSide(side string) string {
+	var sb strings.Builder
+	for _, piece := range "KQRBNP" {
+		sb.WriteString(strings.Repeat(string(piece), strings.Count(side, string(piece))))
+	}
+	return sb.String()
+}
+
+// Set up every position of the table, and score it by looking one ply ahead. The
+// positions are split between as many goroutines as there are CPUs.
+func (gen *dtmGenerator) initialize() error {
+	numEntries := gen.table.numEntries()
+	gen.scores = make([]int16, numEntries)
+	gen.counts = make([]uint8, numEntries)
+	gen.flags = make([]uint8, numEntries)
+
+	numWorkers := runtime.NumCPU()
+	chunkSize := (numEntries + numWorkers - 1) / numWorkers
+
+	var wg sync.WaitGroup
+	for start := 0; start < numEntries; start += chunkSize {
+		wg.Add(1)
+		go func(start, end int) {
+			defer wg.Done()
+			for idx := start; idx < end; idx++ {
+				gen.initializeEntry(idx)
+			}
+		}(start, min(start+chunkSize, numEntries))
+	}
+	wg.Wait()
+
+	for idx := 0; idx < numEntries; idx++ {
+		if gen.flags[idx]&dtmInvalidFlag != 0 {
+			continue
+		}
+
+		score := gen.scores[idx]
+		switch {
+		case score > 0 || (gen.counts[idx] == 0 && score < 0):
+			if err := gen.push(idx, score); err != nil {
+				return err
+			}
+		case gen.counts[idx] == 0:
+			gen.scores[idx] = 0
+			gen.flags[idx] |= dtmResolvedFlag
+		}
+	}
+	return nil
+}
+
+func (gen *dtmGenerator) initializeEntry(idx int) {
+	table := gen.table
+	var squares, childSquares [DTMMaxPieces]uint8
+	numPieces := len(table.pieces)
+	side := table.decodeIndex(idx, squares[:numPieces])
+
+	// Skip arrangements with pieces on the same square, pawns on the first or last
+	// rank, and those stored under another index, since they're mirror images.
+	occupied := uint64(0)
+	for i, sq := range squares[:numPieces] {
+		if IsBitset(occupied, sq) {
+			gen.flags[idx] = dtmInvalidFlag
+			return
+		}
+		occupied = SetBit(occupied, sq)
+
+		if table.pieces[i].pieceType == Pawn && (RankOf(sq) == Rank1 || RankOf(sq) == Rank8) {
+			gen.flags[idx] = dtmInvalidFlag
+			return
+		}
+	}
+
+	if table.index(squares[:numPieces], side) != idx {
+		gen.flags[idx] = dtmInvalidFlag
+		return
+	}
+
+	pos := Position{EPSq: NoSq, Side: side}
+	for i, sq := range squares[:numPieces] {
+		pos.putPiece(table.pieces[i].pieceType, table.pieces[i].color, sq)
+	}
+
+	if pos.IsSideInCheck(side ^ 1) {
+		gen.flags[idx] = dtmInvalidFlag
+		return
+	}
+
+	bestScore := dtmUnknownScore
+	legalMoves := 0
+	children := make([]int, 0, 32)
+
+	var child Position
+	for _, move := range genMoves(&pos) {
+		CopyPos(&pos, &child)
+		child.DoMove(move)
+		if child.IsSideInCheck(side) {
+			continue
+		}
+		legalMoves++
+
+		// Moves leaving the table can be scored straight away, while the moves staying
+		// in it are counted, so it's known when they've all been scored.
+		if move.IsCapture() || move.IsPromotion() {
+			childScore, ok := probeDTM(&child)
+			if !ok {
+				panic(fmt.Sprintf("missing tablebase for %s", tbMaterialKey(&child)))
+			}
+			bestScore = max(bestScore, parentDTMScore(childScore))
+			continue
+		}
+
+		childSide := table.positionSquares(&child, false, childSquares[:numPieces])
+		childIdx := table.index(childSquares[:numPieces], childSide)
+		if !containsIdx(children, childIdx) {
+			children = append(children, childIdx)
+		}
+	}
+
+	if legalMoves == 0 {
+		if pos.IsSideInCheck(side) {
+			bestScore = -DTMWinScore
+		} else {
+			bestScore = 0
+		}
+	}
+
+	gen.scores[idx] = bestScore
+	gen.counts[idx] = uint8(len(children))
+}
+
+// Propagate the scores backwards, from the positions closest to mate outwards. Every
+// position is pushed into the bucket of its score when it's found to be won or lost,
+// but the score of a win can still improve before the bucket's reached, in which case
+// the older entry is simply skipped.
+func (gen *dtmGenerator) propagate() error {
+	table := gen.table
+	numPieces := len(table.pieces)
+	var squares [DTMMaxPieces]uint8
+
+	for plies := 0; plies <= DTMMaxPlies; plies++ {
+		for i := 0; i < len(gen.buckets[plies]); i++ {
+			idx := gen.buckets[plies][i]
+			score := gen.scores[idx]
+			if gen.flags[idx]&dtmResolvedFlag != 0 || dtmPlies(score) != plies {
+				continue
+			}
+			gen.flags[idx] |= dtmResolvedFlag
+
+			side := table.decodeIndex(idx, squares[:numPieces])
+			for _, parentIdx := range gen.unmoves(squares[:numPieces], side) {
+				if gen.flags[parentIdx]&(dtmInvalidFlag|dtmResolvedFlag) != 0 {
+					continue
+				}
+
+				parentScore := parentDTMScore(score)
+				if score < 0 {
+					// Any move into a lost position wins.
+					if parentScore > gen.scores[parentIdx] {
+						gen.scores[parentIdx] = parentScore
+						if err := gen.push(parentIdx, parentScore); err != nil {
+							return err
+						}
+					}
+					continue
+				}
+
+				// Only once every move's been found to lead to a won position is the
+				// position lost, and it then holds out as long as possible.
+				gen.scores[parentIdx] = max(gen.scores[parentIdx], parentScore)
+				gen.counts[parentIdx]--
+				if gen.counts[parentIdx] == 0 && gen.scores[parentIdx] < 0 {
+					if err := gen.push(parentIdx, gen.scores[parentIdx]); err != nil {
+						return err
+					}
+				}
+			}
+		}
+		gen.buckets[plies] = nil
+	}
+	return nil
+}
+
+// Get the indexes of every position a quiet move of the side which just moved could
+// have been made from. Captures and promotions are never un-made, since the position
+// before them has different material.
+func (gen *dtmGenerator) unmoves(squares []uint8, side uint8) []int {
+	table := gen.table
+	mover := side ^ 1
+	parentSide := mover
+
+	occupied := uint64(0)
+	for _, sq := range squares {
+		occupied = SetBit(occupied, sq)
+	}
+
+	var parentSquares [DTMMaxPieces]uint8
+	parents := make([]int, 0, 32)
+
+	for i, piece := range table.pieces {
+		if piece.color != mover {
+			continue
+		}
+
+		toSq := squares[i]
+		fromSquares := uint64(0)
+
+		switch piece.pieceType {
+		case Pawn:
+			fromSquares = pawnUnmoves(toSq, mover, occupied)
+		case Knight:
+			fromSquares = KnightMoves[toSq]
+		case Bishop:
+			fromSquares = LookupBishopMoves(toSq, occupied)
+		case Rook:
+			fromSquares = LookupRookMoves(toSq, occupied)
+		case Queen:
+			fromSquares = LookupBishopMoves(toSq, occupied) | LookupRookMoves(toSq, occupied)
+		case King:
+			fromSquares = KingMoves[toSq]
+		}
+
+		for fromSquares &= ^occupied; fromSquares != 0; fromSquares &= fromSquares - 1 {
+			copy(parentSquares[:], squares)
+			parentSquares[i] = GetLSBpos(fromSquares)
+
+			parentIdx := table.index(parentSquares[:len(squares)], parentSide)
+			if !containsIdx(parents, parentIdx) {
+				parents = append(parents, parentIdx)
+			}
+		}
+	}
+
+	return parents
+}
+
+// Get the squares a pawn now on the given square could have been pushed from.
+func pawnUnmoves(toSq, color uint8, occupied uint64) uint64 {
+	fromSquares := uint64(0)
+	if color == White {
+		if RankOf(toSq) >= Rank3 && !IsBitset(occupied, toSq-8) {
+			fromSquares = SetBit(fromSquares, toSq-8)
+			if RankOf(toSq) == Rank4 && !IsBitset(occupied, toSq-16) {
+				fromSquares = SetBit(fromSquares, toSq-16)
+			}
+		}
+	} else {
+		if RankOf(toSq) <= Rank6 && !IsBitset(occupied, toSq+8) {
+			fromSquares = SetBit(fromSquares, toSq+8)
+			if RankOf(toSq) == Rank5 && !IsBitset(occupied, toSq+16) {
+				fromSquares = SetBit(fromSquares, toSq+16)
+			}
+		}
+	}
+	return fromSquares
+}
+
+// Queue the position to have its score propagated once its bucket is reached. Mates
+// longer than DTMMaxPlies can't be stored in a table, so they fail the generation.
+func (gen *dtmGenerator) push(idx int, score int16) error {
+	plies := dtmPlies(score)
+	if plies > DTMMaxPlies {
+		return fmt.Errorf("mate in %d plies in %s is too long to be stored", plies, gen.table.key)
+	}
+	gen.buckets[plies] = append(gen.buckets[plies], idx)
+	return nil
+}
+
+// Encode the final scores. Any position never resolved is a draw.
+func (gen *dtmGenerator) finish() {
+	table := gen.table
+	table.entries = make([]uint8, len(gen.scores))
+	for idx, score := range gen.scores {
+		if gen.flags[idx]&dtmResolvedFlag != 0 {
+			table.entries[idx] = encodeDTMScore(score)
+		}
+	}
+	table.loadOnce.Do(func() { table.loaded = true })
+}
+
+func (gen *dtmGenerator) stats() (wins, losses, draws, longest int) {
+	for idx, score := range gen.scores {
+		if gen.flags[idx]&dtmInvalidFlag != 0 {
+			continue
+		}
+
+		score = decodeDTMEntry(gen.table.entries[idx])
+		switch {
+		case score > 0:
+			wins++
+		case score < 0:
+			losses++
+		default:
+			draws++
+		}
+
+		if score != 0 {
+			longest = max(longest, dtmPlies(score))
+		}
+	}
+	return wins, losses, draws, longest
+}
+
+// Convert the score of a position into the score of the position before it.
+func parentDTMScore(score int16) int16 {
+	switch {
+	case score > 0:
+		return -score + 1
+	case score < 0:
+		return -score - 1
+	}
+	return 0
+}
+
+func containsIdx(indexes []int, idx int) bool {
+	for _, other := range indexes {
+		if other == idx {
+			return true
+		}
+	}
+	return false
+}
@@ -1,11 +1,15 @@
 package engine
 
-import "time"
+import (
+	"sync/atomic"
+	"time"
+)
 
 const (
 	MovesToGoTimingFormat = iota
 	SuddenDeathTimeFormat
 	InfiniteTimeFormat
+	FixedTimeFormat
 	NoFormat
 
 	TimeBuffer          int64 = 100
@@ -19,8 +23,13 @@ type Timer struct {
 	movesToGo,
 	movesToGoHalved,
 	coeff           int64
-	Stopped,
 	infiniteTime    bool
+
+	// Set by whichever thread stops the search, and read by every thread searching.
+	Stopped atomic.Bool
+
+	// Set by the UCI thread on ponderhit, and read by every thread searching.
+	pondering atomic.Bool
 }
 
 func (timer *Timer) Init() {
@@ -30,7 +39,8 @@ func (timer *Timer) Init() {
 }
 
 func (timer *Timer) CalculateSearchTime(timeFormat int, movesToGo, timeLeft, timeInc int64, numOfMoves uint16) {
-	timer.Stopped = false
+	timer.Stopped.Store(false)
+	timer.pondering.Store(false)
 	bonus := timeInc / 2
 
 	switch timeFormat {
@@ -42,6 +52,12 @@ func (timer *Timer) CalculateSearchTime(timeFormat int, movesToGo, timeLeft, tim
 		timer.infiniteTime = false
 	case InfiniteTimeFormat:
 		timer.infiniteTime = true
+	case FixedTimeFormat:
+		// The time left is the exact time to search for, so
+		// don't bother budgeting any of it.
+		timer.searchTime = timeLeft
+		timer.infiniteTime = false
+		return
 	}
 
 	if timer.searchTime > TimeBuffer {
@@ -57,11 +73,26 @@ func (timer *Timer) Start() {
 }
 
 func (timer *Timer) Update()  {
-	if !timer.infiniteTime && time.Since(timer.startTime).Milliseconds() >= timer.searchTime {
-		timer.Stopped = true
+	if !timer.infiniteTime && !timer.pondering.Load() && time.Since(timer.startTime).Milliseconds() >= timer.searchTime {
+		timer.Stopped.Store(true)
 	}
 }
 
+// Search without any time limit until PonderHit is called. The search time calculated
+// beforehand is kept, so once the opponent plays the expected move, the search continues
+// with its normal time allocation, minus however long has already been spent pondering.
+func (timer *Timer) StartPondering() {
+	timer.pondering.Store(true)
+}
+
+func (timer *Timer) PonderHit() {
+	timer.pondering.Store(false)
+}
+
+func (timer *Timer) IsPondering() bool {
+	return timer.pondering.Load()
+}
+
 func (timer *Timer) CalcTimeLeftDivide(numOfMoves uint16) int64 {
 	numOfMovesInt64 := int64(numOfMoves)
 	
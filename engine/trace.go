@@ -0,0 +1,183 @@
+package engine
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	MaterialTerm = iota
+	PSQTTerm
+	PawnStructureTerm
+	PassedPawnsTerm
+	MobilityTerm
+	KingAttacksTerm
+	PawnShieldTerm
+	NumEvalTerms
+)
+
+var EvalTermNames = [NumEvalTerms]string{
+	"Material",
+	"PSQT",
+	"Pawn structure",
+	"Passed pawns",
+	"Mobility",
+	"King attacks",
+	"Pawn shield",
+}
+
+// An evaluation trace records the middlegame and endgame contribution of each
+// evaluation term for each side, indexed by term, then color, then phase, along
+// with the coefficients of the term's weights.
+type EvalTrace struct {
+	Terms        [NumEvalTerms][2][2]int16
+	Coefficients EvalCoefficients
+}
+
+// The coefficient of each evaluation weight for each side, which is how many times
+// the weight was added to the side's score, negated for penalties. Every term is
+// linear in its weights, so a side's score for a term is the sum of each weight times
+// its coefficient. The tuner relies on this to tune the weights. The arrays are
+// indexed by color, then laid out like the weights themselves.
+type EvalCoefficients struct {
+	DoubledPawns   [2]float64
+	IsolatedPawns  [2]float64
+	BackwardPawns  [2]float64
+	ConnectedPawns [2]float64
+	PassedPawns    [2][8]float64
+	Mobility       [2][6]float64
+	KingAttacks    [2][6]float64
+	PawnShield     [2][2]float64
+}
+
+// Evaluate the position with the evaluation terms, even if a network is loaded, and
+// return the coefficients of their weights.
+func TraceCoefficients(pos *Position) EvalCoefficients {
+	trace := EvalTrace{}
+	evaluate(pos, nil, &trace)
+	return trace.Coefficients
+}
+
+func (trace *EvalTrace) add(term int, color uint8, mgScore, egScore int16) {
+	if trace == nil {
+		return
+	}
+	trace.Terms[term][color][MG] += mgScore
+	trace.Terms[term][color][EG] += egScore
+}
+
+// Evaluate the position while recording the contribution of each term, and return a
+// human readable breakdown of the evaluation, followed by a grid of what the piece on
+// each square contributes through the piece-square tables. All scores are given from
+// white's perspective.
+func TraceEvaluation(pos *Position) string {
+	trace := EvalTrace{}
+	score := evaluate(pos, nil, &trace)
+	if pos.Side == Black {
+		score = -score
+	}
+
+	// Split the piece-square table scores into the average value of each piece,
+	// and the bonus or penalty for where it stands.
+	for sq := uint8(0); sq < 64; sq++ {
+		pieceType := pos.GetPieceTypeOnSq(sq)
+		if pieceType == NoType {
+			continue
+		}
+
+		color := pos.GetPieceColorOnSq(sq)
+		mgValue := MGPieceSquareTable[pieceType][FlipSq[color][sq]]
+		egValue := EGPieceSquareTable[pieceType][FlipSq[color][sq]]
+		mgMaterial := averagePieceValue(&MGPieceSquareTable[pieceType], pieceType)
+		egMaterial := averagePieceValue(&EGPieceSquareTable[pieceType], pieceType)
+
+		trace.add(MaterialTerm, color, mgMaterial, egMaterial)
+		trace.add(PSQTTerm, color, mgValue-mgMaterial, egValue-egMaterial)
+	}
+
+	var sb strings.Builder
+	sb.WriteString("\n")
+	sb.WriteString("      Term      |    White    |    Black    |    Total\n")
+	sb.WriteString("                |   MG    EG  |   MG    EG  |   MG    EG\n")
+	sb.WriteString(" ---------------+-------------+-------------+-------------\n")
+
+	var totals [2][2]int16
+	for term := 0; term < NumEvalTerms; term++ {
+		scores := trace.Terms[term]
+		writeTraceRow(&sb, EvalTermNames[term], scores)
+
+		for color := uint8(White); color <= Black; color++ {
+			totals[color][MG] += scores[color][MG]
+			totals[color][EG] += scores[color][EG]
+		}
+	}
+
+	sb.WriteString(" ---------------+-------------+-------------+-------------\n")
+	writeTraceRow(&sb, "Total", totals)
+
+	phase := min(pos.Phase, TotalPhase)
+	sb.WriteString(fmt.Sprintf("\nphase: %d/%d\n", phase, TotalPhase))
+	sb.WriteString(fmt.Sprintf("evaluation: %+.2f (white side)\n", float64(score)/100))
+
+	if activeNetwork != nil {
+		netPos := *pos
+		netPos.refreshAccumulator()
+		netScore := activeNetwork.evaluate(&netPos)
+		if pos.Side == Black {
+			netScore = -netScore
+		}
+		sb.WriteString(fmt.Sprintf("nnue evaluation: %+.2f (white side)\n", float64(netScore)/100))
+	}
+
+	sb.WriteString("\npiece-square table contributions (tapered, white side):\n\n")
+	for rank := 7; rank >= 0; rank-- {
+		sb.WriteString(fmt.Sprintf("%d |", rank+1))
+		for file := 0; file < 8; file++ {
+			sq := uint8(rank*8 + file)
+			pieceType := pos.GetPieceTypeOnSq(sq)
+			if pieceType == NoType {
+				sb.WriteString("     .")
+				continue
+			}
+
+			color := pos.GetPieceColorOnSq(sq)
+			mgValue := int32(MGPieceSquareTable[pieceType][FlipSq[color][sq]])
+			egValue := int32(EGPieceSquareTable[pieceType][FlipSq[color][sq]])
+			value := (mgValue*int32(phase) + egValue*int32(TotalPhase-phase)) / int32(TotalPhase)
+			if color == Black {
+				value = -value
+			}
+			sb.WriteString(fmt.Sprintf(" %5d", value))
+		}
+		sb.WriteString("\n")
+	}
+
+	sb.WriteString("   ------------------------------------------------")
+	sb.WriteString("\n        a     b     c     d     e     f     g     h\n")
+	return sb.String()
+}
+
+func writeTraceRow(sb *strings.Builder, name string, scores [2][2]int16) {
+	sb.WriteString(fmt.Sprintf(
+		" %-14s | %5d %5d | %5d %5d | %5d %5d\n",
+		name,
+		scores[White][MG], scores[White][EG],
+		scores[Black][MG], scores[Black][EG],
+		scores[White][MG]-scores[Black][MG], scores[White][EG]-scores[Black][EG],
+	))
+}
+
+// Get the average value of a piece over the squares it can stand on. Pawns can
+// never stand on the first or last rank, so those squares are skipped.
+func averagePieceValue(table *[64]int16, pieceType uint8) int16 {
+	start, end := 0, 64
+	if pieceType == Pawn {
+		start, end = 8, 56
+	}
+
+	sum := 0
+	for sq := start; sq < end; sq++ {
+		sum += int(table[sq])
+	}
+	return int16(sum / (end - start))
+}
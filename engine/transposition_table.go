@@ -2,17 +2,32 @@ package engine
 
 const (
 	PerftEntrySize            = 16
+	SearchEntrySize           = 16
 	MBtoBytesConversionFactor = 1024 * 1024
 
 	PerftEntryNodesMask = 0xffffffffffffff
 	PeftEntryDepthMask  = 0xf00000000000000
 
+	SearchEntryScoreMask = 0xffff
+	SearchEntryMoveMask  = 0x7ffff0000
+	SearchEntryDepthMask = 0x7f800000000
+	SearchEntryFlagMask  = 0x180000000000
+	SearchEntryAgeMask   = 0x1fe00000000000
+
 	NumBuckets = 4
 )
 
+const (
+	NoFlag uint8 = iota
+	ExactFlag
+	LowerBoundFlag
+	UpperBoundFlag
+)
+
 type TTEntry interface {
 	Hash() uint64
 	Depth() uint8
+	Age() uint8
 }
 
 type PerftEntry struct {
@@ -28,6 +43,10 @@ func (entry PerftEntry) Depth() uint8 {
 	return uint8(entry.nodesAndDepth & PeftEntryDepthMask >> 56)
 }
 
+func (entry PerftEntry) Age() uint8 {
+	return 0
+}
+
 func (entry PerftEntry) Nodes() uint64 {
 	return entry.nodesAndDepth & PerftEntryNodesMask
 }
@@ -39,13 +58,101 @@ func (entry *PerftEntry) SetData(hash, nodes uint64, depth uint8) {
 	entry.nodesAndDepth |= (uint64(depth) << 56)
 }
 
+// A search entry packs everything but the hash into a single 64 bit integer with
+// the following structure (starting with LSB):
+// 16-bits: score
+// 19-bits: best move (without its ordering score)
+// 8-bits: depth
+// 2-bits: bound flag
+// 8-bits: age
+//
+// Since the table is shared between search threads without any locking, the hash
+// is stored XOR-ed with the data. An entry torn by two threads writing to it at the
+// same time then no longer matches the hash of any position, and is simply ignored.
+type SearchEntry struct {
+	hash uint64
+	data uint64
+}
+
+func (entry SearchEntry) Hash() uint64 {
+	return entry.hash ^ entry.data
+}
+
+func (entry SearchEntry) Depth() uint8 {
+	return uint8((entry.data & SearchEntryDepthMask) >> 35)
+}
+
+func (entry SearchEntry) Age() uint8 {
+	return uint8((entry.data & SearchEntryAgeMask) >> 45)
+}
+
+func (entry SearchEntry) Score() int16 {
+	return int16(uint16(entry.data & SearchEntryScoreMask))
+}
+
+func (entry SearchEntry) Move() Move {
+	return Move((entry.data & SearchEntryMoveMask) >> 16)
+}
+
+func (entry SearchEntry) Flag() uint8 {
+	return uint8((entry.data & SearchEntryFlagMask) >> 43)
+}
+
+// Get the score stored in the entry, adjusted to be relative to the current ply if
+// it's a mate score. The second value returned is true only if the entry was searched
+// deep enough, and has the right kind of bound, to cause a cutoff in the current node.
+func (entry SearchEntry) Get(depth, ply uint8, alpha, beta int16) (int16, bool) {
+	score := entry.Score()
+	if score >= LongestCheckmate {
+		score -= int16(ply)
+	} else if score <= -LongestCheckmate {
+		score += int16(ply)
+	}
+
+	if entry.Depth() < depth {
+		return score, false
+	}
+
+	switch entry.Flag() {
+	case ExactFlag:
+		return score, true
+	case LowerBoundFlag:
+		return score, score >= beta
+	case UpperBoundFlag:
+		return score, score <= alpha
+	}
+
+	return score, false
+}
+
+// Set the data of the entry. Mate scores are stored relative to the current
+// node rather than the root, since the same position can be reached at
+// different plies.
+func (entry *SearchEntry) SetData(hash uint64, move Move, score int16, depth, ply, flag, age uint8) {
+	if score >= LongestCheckmate {
+		score += int16(ply)
+	} else if score <= -LongestCheckmate {
+		score -= int16(ply)
+	}
+
+	data := uint64(uint16(score))
+	data |= uint64(move&FlippedMoveScoreBitmask) << 16
+	data |= uint64(depth) << 35
+	data |= uint64(flag) << 43
+	data |= uint64(age) << 45
+
+	entry.data = data
+	entry.hash = hash ^ data
+}
+
 type TranspositionTable[T TTEntry] struct {
 	entries []T
 	size    uint64
+	age     uint8
 }
 
 func (tt *TranspositionTable[T]) SetSize(sizeInMB, entrySize uint64) {
-	tt.size = sizeInMB * MBtoBytesConversionFactor / PerftEntrySize
+	tt.size = sizeInMB * MBtoBytesConversionFactor / entrySize
 	tt.entries = make([]T, tt.size)
 }
 
@@ -60,21 +167,33 @@ func (tt *TranspositionTable[T]) Probe(hash uint64) *T {
 	return nil
 }
 
+// Find the entry to overwrite when storing a position. Prefer the slot already
+// holding the position, then slots left over from previous searches, and finally
+// slots holding shallower or equal depth searches.
 func (tt *TranspositionTable[T]) Store(hash uint64, depth uint8) *T {
 	start_index := hash % tt.size
 	for i := uint64(0); i < NumBuckets; i++ {
 		entry := &tt.entries[(start_index+i)%tt.size]
-		if (*entry).Depth() <= depth {
+		if (*entry).Hash() == hash || (*entry).Age() != tt.age || (*entry).Depth() <= depth {
 			return entry
 		}
 	}
 	return &tt.entries[(start_index+NumBuckets)%tt.size]
 }
 
+func (tt *TranspositionTable[T]) Age() uint8 {
+	return tt.age
+}
+
+func (tt *TranspositionTable[T]) IncAge() {
+	tt.age++
+}
+
 func (tt *TranspositionTable[T]) Clear() {
 	for i := uint64(0); i < tt.size; i++ {
 		tt.entries[i] = *new(T)
 	}
+	tt.age = 0
 }
 
 func (tt *TranspositionTable[T]) Unitialize() {
@@ -54,5 +54,19 @@ func GenHash(pos *Position) (hash uint64) {
 	hash ^= CastlingZobristValues[pos.Castling]
 	hash ^= SideZobristValues[pos.Side]
 
+	return hash
+}
+
+// Generate a hash of only the pawns in the position, which is used to key
+// the pawn structure evaluation cache.
+func GenPawnHash(pos *Position) (hash uint64) {
+	for color := uint8(White); color <= Black; color++ {
+		pawnsBB := pos.Pieces[Pawn] & pos.Colors[color]
+		for pawnsBB != 0 {
+			sq := GetLSBpos(pawnsBB)
+			hash ^= PieceZobristValues[color][Pawn][sq]
+			pawnsBB &= pawnsBB - 1
+		}
+	}
 	return hash
 }
\ No newline at end of file
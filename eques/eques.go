@@ -9,6 +9,7 @@ import (
 	"fmt"
 	"os"
 	"runtime/debug"
+	"strings"
 	"time"
 )
 
@@ -18,17 +19,47 @@ const (
 	DefaultLearningRate float64 = 0.8
 	DefaultIterations   int     = 2000
 	DefaultRecordRate   int     = 40
+	DefaultOptimizer    string  = "adagrad"
+	DefaultMomentum     float64 = 0.9
+	DefaultLRDecay      float64 = 1
+	DefaultBatchSize    int     = 0
+	DefaultHoldout      float64 = 0.1
+	DefaultPatience     int     = 0
+	DefaultSaveFile     string  = "tuner_checkpoint.gob"
+	DefaultSaveRate     int     = 100
 	DefaultDepth        uint    = 1
 	DefaultTTSize       uint64  = 16
 	DefaultNumThreads   int     = 1
 	DefaultOutfile      string  = "fens.csv"
 	DefaultSampleSize   uint    = 20
 	DefaultScoreBound   uint    = 50
+
+	DefaultTrainEpochs          int     = 10
+	DefaultTrainBatchSize       int     = 16384
+	DefaultTrainLearningRate    float64 = 0.001
+	DefaultTrainLRDropFactor    float64 = 0.3
+	DefaultTrainLRDropEvery     int     = 4
+	DefaultTrainValidationSplit float64 = 0.1
+	DefaultTrainCheckpointEvery int     = 1
+	DefaultTrainWDLWeight       float64 = 0.5
+	DefaultTrainOutDir          string  = "nnue"
+
+	DefaultSelfplayOutfile         string = "selfplay.csv"
+	DefaultSelfplayGames           int    = 1000
+	DefaultSelfplayNodes           uint64 = 5000
+	DefaultSelfplayRandomPlies     int    = 8
+	DefaultSelfplayOpeningMaxScore int    = 200
+	DefaultSelfplayResignScore     int    = 1000
+	DefaultSelfplayResignPlies     int    = 6
+	DefaultSelfplayDrawScore       int    = 10
+	DefaultSelfplayDrawPlies       int    = 12
+	DefaultSelfplayDrawMinPly      int    = 80
 )
 
 func init() {
 	engine.InitTables()
 	engine.InitZobristValues()
+	engine.InitSearchTables()
 }
 
 func processTuneCommand() {
@@ -43,7 +74,34 @@ func processTuneCommand() {
 	tuneLearningRate := tuneCmd.Float64(
 		"learning_rate",
 		DefaultLearningRate,
-		"The default learning rate to use when performing (AdaGrad) gradient descent.",
+		"The default learning rate to use when performing gradient descent. The right scale depends\n" +
+		"on the optimizer, as AdaGrad and Adam take steps of roughly the learning rate, while SGD's\n" +
+		"steps are proportional to the gradient.",
+	)
+
+	tuneOptimizer := tuneCmd.String(
+		"optimizer",
+		DefaultOptimizer,
+		"The optimizer to use when applying the gradient: adagrad, adam, or sgd (with momentum).",
+	)
+
+	tuneMomentum := tuneCmd.Float64(
+		"momentum",
+		DefaultMomentum,
+		"The momentum to use with the sgd optimizer.",
+	)
+
+	tuneLRDecay := tuneCmd.Float64(
+		"lr_decay",
+		DefaultLRDecay,
+		"How much to multiply the learning rate by after each iteration.",
+	)
+
+	tuneBatchSize := tuneCmd.Int(
+		"batch_size",
+		DefaultBatchSize,
+		"The number of positions in each mini-batch. Each iteration is a full pass over the shuffled\n" +
+		"data, taking a step per mini-batch. Zero computes the gradient over the whole dataset.",
 	)
 
 	tuneIterations := tuneCmd.Int(
@@ -66,6 +124,53 @@ func processTuneCommand() {
 		"of the tuning process.",
 	)
 
+	tuneFromEngine := tuneCmd.Bool(
+		"from_engine",
+		false,
+		"Start tuning from the weights the engine currently uses, rather than from the base piece\n" +
+		"values, with every other evaluation term at zero.",
+	)
+
+	tuneValidationSplit := tuneCmd.Float64(
+		"validation_split",
+		DefaultHoldout,
+		"The fraction of the data held out to measure the validation error, which is recorded\n" +
+		"alongside the training error.",
+	)
+
+	tunePatience := tuneCmd.Int(
+		"patience",
+		DefaultPatience,
+		"Stop early, keeping the best weights, once the validation error hasn't improved in\n" +
+		"<patience> recordings of the error. Zero never stops early.",
+	)
+
+	tuneCheckpointFile := tuneCmd.String(
+		"checkpoint_file",
+		DefaultSaveFile,
+		"The file to save checkpoints of the weights and optimizer state to. A checkpoint is also\n" +
+		"saved when tuning finishes, stops early, or is interrupted with Ctrl-C.",
+	)
+
+	tuneCheckpointEvery := tuneCmd.Int(
+		"checkpoint_every",
+		DefaultSaveRate,
+		"Save a checkpoint every <checkpoint_every> iterations. Zero only saves one when tuning ends.",
+	)
+
+	tuneResume := tuneCmd.String(
+		"resume",
+		"",
+		"A checkpoint file to resume tuning from, with the same data file and optimizer.",
+	)
+
+	tuneK := tuneCmd.Float64(
+		"k",
+		0,
+		"The scaling constant used to convert an evaluation into a win probability. By default,\n" +
+		"the K which minimizes the mean-square error of the starting weights is found and used.",
+	)
+
 	tuneCmd.Parse(os.Args[2:])
 
 	if *tuneDataFile == "" {
@@ -73,9 +178,131 @@ func processTuneCommand() {
 		return
 	}
 
-	weights := tuner.Weights{}
-	weights.LoadBaseWeights()
-	weights.TuneWeights(*tuneDataFile, *tuneLearningRate, *tuneIterations, *tuneNumThreads, *tuneRecordErrEveryNth)
+	weights := tuner.NewWeights(tuner.FeatureSets)
+	if *tuneFromEngine {
+		weights.LoadEngineWeights()
+	} else {
+		weights.LoadBaseWeights()
+	}
+	weights.TuneWeights(tuner.TunerConfig{
+		DataFile:          *tuneDataFile,
+		K:                 *tuneK,
+		Optimizer:         *tuneOptimizer,
+		LearningRate:      *tuneLearningRate,
+		Momentum:          *tuneMomentum,
+		LRDecay:           *tuneLRDecay,
+		BatchSize:         *tuneBatchSize,
+		Iterations:        *tuneIterations,
+		NumThreads:        *tuneNumThreads,
+		RecordErrEveryNth: *tuneRecordErrEveryNth,
+		ValidationSplit:   *tuneValidationSplit,
+		Patience:          *tunePatience,
+		CheckpointFile:    *tuneCheckpointFile,
+		CheckpointEvery:   *tuneCheckpointEvery,
+		Resume:            *tuneResume,
+	})
+}
+
+func processTrainCommand() {
+	trainCmd := flag.NewFlagSet("train", flag.ExitOnError)
+
+	trainDataFile := trainCmd.String(
+		"infile",
+		"",
+		"The training data. Should be a CSV file with a header, a fen column, and an outcome\n" +
+		"column (white win=1.0, black win=0.0, draw=0.5). An optional score column holds search\n" +
+		"scores in centi-pawns from white's perspective.",
+	)
+
+	trainOutDir := trainCmd.String(
+		"outdir",
+		DefaultTrainOutDir,
+		"The directory to write checkpoints and networks into.",
+	)
+
+	trainWDLWeight := trainCmd.Float64(
+		"wdl_weight",
+		DefaultTrainWDLWeight,
+		"How much the outcome counts towards each position's target, when the data has scores.\n" +
+		"The rest comes from the score, converted into a win probability.",
+	)
+
+	trainEpochs := trainCmd.Int(
+		"epochs",
+		DefaultTrainEpochs,
+		"The number of passes over the training data.",
+	)
+
+	trainBatchSize := trainCmd.Int(
+		"batch_size",
+		DefaultTrainBatchSize,
+		"The number of positions in each mini-batch.",
+	)
+
+	trainLearningRate := trainCmd.Float64(
+		"learning_rate",
+		DefaultTrainLearningRate,
+		"The learning rate to start Adam with.",
+	)
+
+	trainLRDropFactor := trainCmd.Float64(
+		"lr_drop_factor",
+		DefaultTrainLRDropFactor,
+		"The factor to multiply the learning rate by every <lr_drop_every> epochs.",
+	)
+
+	trainLRDropEvery := trainCmd.Int(
+		"lr_drop_every",
+		DefaultTrainLRDropEvery,
+		"The number of epochs between drops of the learning rate. Zero keeps it constant.",
+	)
+
+	trainValidationSplit := trainCmd.Float64(
+		"validation_split",
+		DefaultTrainValidationSplit,
+		"The fraction of the data held out to measure the validation loss.",
+	)
+
+	trainCheckpointEvery := trainCmd.Int(
+		"checkpoint_every",
+		DefaultTrainCheckpointEvery,
+		"Save a checkpoint, and export the network, every <checkpoint_every> epochs.",
+	)
+
+	trainNumThreads := trainCmd.Int(
+		"num_threads",
+		DefaultNumThreads,
+		"The number of \"threads\" (go-routines) to spawn to paralleize training.",
+	)
+
+	trainResume := trainCmd.String(
+		"resume",
+		"",
+		"A checkpoint file to resume training from.",
+	)
+
+	trainCmd.Parse(os.Args[2:])
+
+	if *trainDataFile == "" {
+		fmt.Println("Please supply a data file to the trainer.")
+		return
+	}
+
+	trainer := tuner.NewNNUETrainer(tuner.NNUETrainerConfig{
+		DataFile:        *trainDataFile,
+		OutDir:          *trainOutDir,
+		WDLWeight:       *trainWDLWeight,
+		Epochs:          *trainEpochs,
+		BatchSize:       max(*trainBatchSize, 1),
+		LearningRate:    *trainLearningRate,
+		LRDropFactor:    *trainLRDropFactor,
+		LRDropEvery:     *trainLRDropEvery,
+		ValidationSplit: *trainValidationSplit,
+		CheckpointEvery: *trainCheckpointEvery,
+		NumThreads:      max(*trainNumThreads, 1),
+		Resume:          *trainResume,
+	})
+	trainer.Train()
 }
 
 func processFenExtractCommand() {
@@ -122,6 +349,130 @@ func processFenExtractCommand() {
 	)
 }
 
+func processSelfplayCommand() {
+	selfplayCmd := flag.NewFlagSet("selfplay", flag.ExitOnError)
+
+	selfplayOutfile := selfplayCmd.String(
+		"outfile",
+		DefaultSelfplayOutfile,
+		"The file to append the recorded positions to.",
+	)
+
+	selfplayFormat := selfplayCmd.String(
+		"format",
+		datagen.SelfplayFormatCSV,
+		"The format to write positions in: \"csv\", with fen, score, and outcome columns, read by\n" +
+		"both tuners, or \"binary\", a compact format read by the NNUE trainer from \".bin\" files.",
+	)
+
+	selfplayGames := selfplayCmd.Int(
+		"games",
+		DefaultSelfplayGames,
+		"The number of games to play.",
+	)
+
+	selfplayNumThreads := selfplayCmd.Int(
+		"num_threads",
+		DefaultNumThreads,
+		"The number of games to play at once, each in its own go-routine.",
+	)
+
+	selfplayNodes := selfplayCmd.Uint64(
+		"nodes",
+		DefaultSelfplayNodes,
+		"The number of nodes to search each move for, unless a depth is given.",
+	)
+
+	selfplayDepth := selfplayCmd.Uint(
+		"depth",
+		0,
+		"The depth to search each move to. When non-zero, it's used instead of the number of nodes.",
+	)
+
+	selfplayRandomPlies := selfplayCmd.Int(
+		"random_plies",
+		DefaultSelfplayRandomPlies,
+		"The number of random moves to start each game with.",
+	)
+
+	selfplayOpeningMaxScore := selfplayCmd.Int(
+		"opening_max_score",
+		DefaultSelfplayOpeningMaxScore,
+		"Openings whose quiescence search score isn't within [-<opening_max_score>, <opening_max_score>]\n" +
+		"centi-pawns are thrown out.",
+	)
+
+	selfplayResignScore := selfplayCmd.Int(
+		"resign_score",
+		DefaultSelfplayResignScore,
+		"Adjudicate a game as won once the score has been at least <resign_score> centi-pawns for\n" +
+		"the same side for <resign_plies> plies in a row.",
+	)
+
+	selfplayResignPlies := selfplayCmd.Int(
+		"resign_plies",
+		DefaultSelfplayResignPlies,
+		"See <resign_score>. Zero turns off resigning.",
+	)
+
+	selfplayDrawScore := selfplayCmd.Int(
+		"draw_score",
+		DefaultSelfplayDrawScore,
+		"Adjudicate a game as drawn once the score has been within [-<draw_score>, <draw_score>]\n" +
+		"centi-pawns for <draw_plies> plies in a row, after the first <draw_min_ply> plies.",
+	)
+
+	selfplayDrawPlies := selfplayCmd.Int(
+		"draw_plies",
+		DefaultSelfplayDrawPlies,
+		"See <draw_score>. Zero turns off draw adjudication.",
+	)
+
+	selfplayDrawMinPly := selfplayCmd.Int(
+		"draw_min_ply",
+		DefaultSelfplayDrawMinPly,
+		"See <draw_score>.",
+	)
+
+	selfplayEvalFile := selfplayCmd.String(
+		"evalfile",
+		"",
+		"An NNUE network to evaluate positions with, instead of the classical evaluation.",
+	)
+
+	selfplayCmd.Parse(os.Args[2:])
+
+	if *selfplayFormat != datagen.SelfplayFormatCSV && *selfplayFormat != datagen.SelfplayFormatBinary {
+		fmt.Printf("Unrecognized format \"%s\".\n", *selfplayFormat)
+		return
+	}
+
+	if *selfplayNodes == 0 && *selfplayDepth == 0 {
+		fmt.Println("Please supply a node or depth limit for each move.")
+		return
+	}
+
+	if err := engine.InitNNUE(*selfplayEvalFile); err != nil {
+		panic(err)
+	}
+
+	datagen.Selfplay(datagen.SelfplayConfig{
+		OutFile:         *selfplayOutfile,
+		Format:          *selfplayFormat,
+		NumGames:        *selfplayGames,
+		NumThreads:      max(*selfplayNumThreads, 1),
+		Nodes:           *selfplayNodes,
+		Depth:           uint8(min(*selfplayDepth, engine.MaxDepth)),
+		RandomPlies:     *selfplayRandomPlies,
+		OpeningMaxScore: int16(*selfplayOpeningMaxScore),
+		ResignScore:     int16(*selfplayResignScore),
+		ResignPlies:     *selfplayResignPlies,
+		DrawScore:       int16(*selfplayDrawScore),
+		DrawPlies:       *selfplayDrawPlies,
+		DrawMinPly:      *selfplayDrawMinPly,
+	})
+}
+
 func processPerftCommand() {
 	perftCmd := flag.NewFlagSet("perft", flag.ExitOnError)
 
@@ -176,6 +527,50 @@ func processPerftCommand() {
 	fmt.Printf("nps: %d\n", uint64(float64(nodes) / float64(endTime.Seconds())))
 }
 
+func processEvalCommand() {
+	evalCmd := flag.NewFlagSet("eval", flag.ExitOnError)
+
+	evalFEN := evalCmd.String(
+		"fen",
+		engine.FENStartPosition,
+		"The position to evaluate as a FEN string.",
+	)
+
+	evalCmd.Parse(os.Args[2:])
+
+	pos := engine.Position{}
+	pos.LoadFEN(*evalFEN)
+	fmt.Println(pos)
+	fmt.Print(engine.TraceEvaluation(&pos))
+}
+
+func processTBGenCommand() {
+	tbGenCmd := flag.NewFlagSet("tbgen", flag.ExitOnError)
+
+	tbGenTables := tbGenCmd.String(
+		"tables",
+		"KQvK,KRvK,KPvK,KBNvK,KRvKP",
+		"A comma separated list of the endgames to generate distance to mate tablebases for.\n" +
+		"Any smaller tables they depend on are generated as well. At most 4 pieces are supported.",
+	)
+
+	tbGenOutDir := tbGenCmd.String(
+		"outdir",
+		".",
+		"The directory to write the tablebases into. Tables already in it aren't generated again.",
+	)
+
+	tbGenCmd.Parse(os.Args[2:])
+
+	if err := os.MkdirAll(*tbGenOutDir, 0755); err != nil {
+		panic(err)
+	}
+
+	if err := engine.GenerateDTMTablebases(strings.Split(*tbGenTables, ","), *tbGenOutDir); err != nil {
+		panic(err)
+	}
+}
+
 func main() {
 	// Essentially setting this argument value higher makes Go's garbage collector less agressive,
 	// which can improve the overall performance of the engine. This does come at the expense of 
@@ -191,10 +586,18 @@ func main() {
 	switch os.Args[1] {
 	case "tune":
 		processTuneCommand()
+	case "train":
+		processTrainCommand()
 	case "perft":
 		processPerftCommand()
 	case "extract":
 		processFenExtractCommand()
+	case "selfplay":
+		processSelfplayCommand()
+	case "eval":
+		processEvalCommand()
+	case "tbgen":
+		processTBGenCommand()
 	case "uci":
 		uci.StartUCIProtocolInterface()	
 	case "-h", "h", "--help", "help":
@@ -202,10 +605,18 @@ func main() {
 		fmt.Print(
 			"    * tune: Run the tuner. Run the program with the flags \"tune -h\"\n" +
 			"      for more details.\n" + 
+			"    * train: Train an NNUE network for the EvalFile option. Run the program with\n" +
+			"      the flags \"train -h\" for more details.\n" +
 			"    * perft: Run perft. Run the program with the flags \"perft -h\"\n" +
 			"      for more details.\n" +
 			"    * extract: Extract FENs, from a given PGN file, for running the tuner. Run\n" +
 			"      \"extract -h\" for more details\n" +
+			"    * selfplay: Generate data for the tuners by having the engine play itself. Run\n" +
+			"      \"selfplay -h\" for more details.\n" +
+			"    * eval: Print a breakdown of the static evaluation of a position. Run\n" +
+			"      \"eval -h\" for more details.\n" +
+			"    * tbgen: Generate distance to mate tablebases for endgames of up to 4 pieces.\n" +
+			"      Run \"tbgen -h\" for more details.\n" +
 			"    * uci: Start the UCI protocol. Program will default to this command if\n" +
 			"      no command is given.\n",
 		)
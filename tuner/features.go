@@ -0,0 +1,271 @@
+package tuner
+
+import (
+	"eques/engine"
+	"fmt"
+	"strings"
+)
+
+// A feature set is a group of tapered evaluation weights, such as the piece-square
+// tables or the mobility bonuses, together with the code to compute how much each of
+// them contributes to the evaluation of a position. Since every evaluation term is
+// linear in its weights, a position's evaluation is just the sum of each weight times
+// its coefficient, and the tuner can optimize every feature set at once.
+//
+// The coefficients are taken from the engine's own evaluation, through the
+// coefficients it records when traced, so the tuner can't drift from it.
+type FeatureSet interface {
+	// The number of weights in the set, each of which has a middlegame and an
+	// endgame value.
+	Size() int
+
+	// Load the values the engine currently uses for the set's weights.
+	Load(mg, eg []float64)
+
+	// Add the coefficients of the set's weights in the position to the given slice,
+	// from white's perspective, given the coefficients traced from its evaluation.
+	Extract(pos *engine.Position, trace *engine.EvalCoefficients, coefficients []float64)
+
+	// Format the weights as Go source which can be pasted into the engine package.
+	Format(mg, eg []float64) string
+}
+
+// The feature sets tuned, in the order their weights are laid out in. The
+// piece-square tables must come first.
+var FeatureSets = []FeatureSet{
+	PSQTFeatures{},
+	PawnStructureFeatures{},
+	PassedPawnFeatures{},
+	MobilityFeatures{},
+	KingAttackFeatures{},
+	PawnShieldFeatures{},
+}
+
+var pieceNames = [6]string{"Pawn", "Knight", "Bishop", "Rook", "Queen", "King"}
+
+func colorSign(color uint8) float64 {
+	if color == engine.White {
+		return 1
+	}
+	return -1
+}
+
+// Add the difference between white's and black's traced coefficients to the given
+// coefficients.
+func addTracedCoefficients(coefficients, white, black []float64) {
+	for i := range coefficients {
+		coefficients[i] += white[i] - black[i]
+	}
+}
+
+func roundWeight(weight float64) int16 {
+	if weight < 0 {
+		return int16(weight - 0.5)
+	}
+	return int16(weight + 0.5)
+}
+
+func formatWeights(weights []float64) string {
+	values := make([]string, len(weights))
+	for i, weight := range weights {
+		values[i] = fmt.Sprint(roundWeight(weight))
+	}
+	return strings.Join(values, ", ")
+}
+
+// Format a pair of middlegame and endgame weights, or, when there are several of
+// each, a table of them indexed by phase.
+func formatPhaseTable(name string, mg, eg []float64) string {
+	if len(mg) == 1 {
+		return fmt.Sprintf("var %s = [2]int16{%s, %s}\n", name, formatWeights(mg), formatWeights(eg))
+	}
+	return fmt.Sprintf(
+		"var %s = [2][%d]int16{\n\t{%s},\n\t{%s},\n}\n",
+		name, len(mg), formatWeights(mg), formatWeights(eg),
+	)
+}
+
+// The piece-square tables, which include the material value of each piece.
+type PSQTFeatures struct{}
+
+func (PSQTFeatures) Size() int {
+	return NumPSQTWeights
+}
+
+func (PSQTFeatures) Load(mg, eg []float64) {
+	for pieceType := engine.Pawn; pieceType < engine.NoType; pieceType++ {
+		for sq := 0; sq < 64; sq++ {
+			mg[pieceType*64+sq] = float64(engine.MGPieceSquareTable[pieceType][sq])
+			eg[pieceType*64+sq] = float64(engine.EGPieceSquareTable[pieceType][sq])
+		}
+	}
+}
+
+func (PSQTFeatures) Extract(pos *engine.Position, _ *engine.EvalCoefficients, coefficients []float64) {
+	for piecesBB := pos.Colors[engine.White] | pos.Colors[engine.Black]; piecesBB != 0; piecesBB &= piecesBB - 1 {
+		sq := engine.GetLSBpos(piecesBB)
+		pieceType := pos.GetPieceTypeOnSq(sq)
+		pieceColor := pos.GetPieceColorOnSq(sq)
+		coefficients[int(pieceType)*64+int(engine.FlipSq[pieceColor][sq])] += colorSign(pieceColor)
+	}
+}
+
+func (PSQTFeatures) Format(mg, eg []float64) string {
+	var sb strings.Builder
+	for phase, weights := range [2][]float64{mg, eg} {
+		phaseName := [2]string{"MG", "EG"}[phase]
+		sb.WriteString(fmt.Sprintf("var %sPieceSquareTable = [6][64]int16{\n", phaseName))
+		for pieceType, name := range pieceNames {
+			sb.WriteString(fmt.Sprintf("\t{\n\t\t// %s %s PST\n", name, phaseName))
+			for rank := 0; rank < 8; rank++ {
+				values := make([]string, 8)
+				for file := 0; file < 8; file++ {
+					values[file] = fmt.Sprintf("%3d,", roundWeight(weights[pieceType*64+rank*8+file]))
+				}
+				sb.WriteString("\t\t" + strings.Join(values, " ") + "\n")
+			}
+			sb.WriteString("\t},\n")
+		}
+		sb.WriteString("}\n\n")
+	}
+	return sb.String()
+}
+
+// The doubled, isolated, and backward pawn penalties, and the connected pawn bonus.
+type PawnStructureFeatures struct{}
+
+const (
+	doubledPawnFeature = iota
+	isolatedPawnFeature
+	backwardPawnFeature
+	connectedPawnFeature
+	numPawnStructureFeatures
+)
+
+var pawnStructureNames = [numPawnStructureFeatures]string{
+	"DoubledPawnPenalty", "IsolatedPawnPenalty", "BackwardPawnPenalty", "ConnectedPawnBonus",
+}
+
+func (PawnStructureFeatures) Size() int {
+	return numPawnStructureFeatures
+}
+
+func (PawnStructureFeatures) Load(mg, eg []float64) {
+	weights := [numPawnStructureFeatures][2]int16{
+		engine.DoubledPawnPenalty,
+		engine.IsolatedPawnPenalty,
+		engine.BackwardPawnPenalty,
+		engine.ConnectedPawnBonus,
+	}
+	for i, weight := range weights {
+		mg[i], eg[i] = float64(weight[engine.MG]), float64(weight[engine.EG])
+	}
+}
+
+func (PawnStructureFeatures) Extract(_ *engine.Position, trace *engine.EvalCoefficients, coefficients []float64) {
+	traced := [numPawnStructureFeatures]*[2]float64{
+		&trace.DoubledPawns,
+		&trace.IsolatedPawns,
+		&trace.BackwardPawns,
+		&trace.ConnectedPawns,
+	}
+	for i, counts := range traced {
+		coefficients[i] += counts[engine.White] - counts[engine.Black]
+	}
+}
+
+func (PawnStructureFeatures) Format(mg, eg []float64) string {
+	var sb strings.Builder
+	for i, name := range pawnStructureNames {
+		sb.WriteString(formatPhaseTable(name, mg[i:i+1], eg[i:i+1]))
+	}
+	return sb.String()
+}
+
+// The passed pawn bonuses, by the rank of the pawn.
+type PassedPawnFeatures struct{}
+
+func (PassedPawnFeatures) Size() int {
+	return 8
+}
+
+func (PassedPawnFeatures) Load(mg, eg []float64) {
+	for rank := 0; rank < 8; rank++ {
+		mg[rank] = float64(engine.PassedPawnBonus[engine.MG][rank])
+		eg[rank] = float64(engine.PassedPawnBonus[engine.EG][rank])
+	}
+}
+
+func (PassedPawnFeatures) Extract(_ *engine.Position, trace *engine.EvalCoefficients, coefficients []float64) {
+	addTracedCoefficients(coefficients, trace.PassedPawns[engine.White][:], trace.PassedPawns[engine.Black][:])
+}
+
+func (PassedPawnFeatures) Format(mg, eg []float64) string {
+	return formatPhaseTable("PassedPawnBonus", mg, eg)
+}
+
+// The mobility bonuses, by piece type.
+type MobilityFeatures struct{}
+
+func (MobilityFeatures) Size() int {
+	return 6
+}
+
+func (MobilityFeatures) Load(mg, eg []float64) {
+	for pieceType := 0; pieceType < 6; pieceType++ {
+		mg[pieceType] = float64(engine.MobilityBonus[engine.MG][pieceType])
+		eg[pieceType] = float64(engine.MobilityBonus[engine.EG][pieceType])
+	}
+}
+
+func (MobilityFeatures) Extract(_ *engine.Position, trace *engine.EvalCoefficients, coefficients []float64) {
+	addTracedCoefficients(coefficients, trace.Mobility[engine.White][:], trace.Mobility[engine.Black][:])
+}
+
+func (MobilityFeatures) Format(mg, eg []float64) string {
+	return formatPhaseTable("MobilityBonus", mg, eg)
+}
+
+// The king zone attack penalties, by the type of the attacking piece.
+type KingAttackFeatures struct{}
+
+func (KingAttackFeatures) Size() int {
+	return 6
+}
+
+func (KingAttackFeatures) Load(mg, eg []float64) {
+	for pieceType := 0; pieceType < 6; pieceType++ {
+		mg[pieceType] = float64(engine.KingAttackWeights[engine.MG][pieceType])
+		eg[pieceType] = float64(engine.KingAttackWeights[engine.EG][pieceType])
+	}
+}
+
+func (KingAttackFeatures) Extract(_ *engine.Position, trace *engine.EvalCoefficients, coefficients []float64) {
+	addTracedCoefficients(coefficients, trace.KingAttacks[engine.White][:], trace.KingAttacks[engine.Black][:])
+}
+
+func (KingAttackFeatures) Format(mg, eg []float64) string {
+	return formatPhaseTable("KingAttackWeights", mg, eg)
+}
+
+// The pawn shield bonuses, by how far in front of the king the pawn stands.
+type PawnShieldFeatures struct{}
+
+func (PawnShieldFeatures) Size() int {
+	return 2
+}
+
+func (PawnShieldFeatures) Load(mg, eg []float64) {
+	for distance := 0; distance < 2; distance++ {
+		mg[distance] = float64(engine.PawnShieldBonus[engine.MG][distance])
+		eg[distance] = float64(engine.PawnShieldBonus[engine.EG][distance])
+	}
+}
+
+func (PawnShieldFeatures) Extract(_ *engine.Position, trace *engine.EvalCoefficients, coefficients []float64) {
+	addTracedCoefficients(coefficients, trace.PawnShield[engine.White][:], trace.PawnShield[engine.Black][:])
+}
+
+func (PawnShieldFeatures) Format(mg, eg []float64) string {
+	return formatPhaseTable("PawnShieldBonus", mg, eg)
+}
@@ -0,0 +1,542 @@
+package tuner
+
+import (
+	"bufio"
+	"encoding/gob"
+	"eques/datagen"
+	"eques/engine"
+	"io"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A trainer for the engine's NNUE network. The network is trained in floating point,
+// with the same architecture as the engine uses, and quantized into the engine's
+// network format whenever it's exported:
+//
+//	768 -> engine.NNUEHiddenSize (x2) -> 1
+//
+// The hidden layer is clipped to [0, 1], which maps onto [0, engine.NNUEQA] once
+// quantized, and the output is converted into a win probability like the Texel tuner
+// does, with sigmoid(K * engine.NNUEScale * output).
+
+const (
+	// The weights and feature biases are kept within these bounds, so they still fit
+	// into an int16 after being quantized, and the accumulator can't overflow: with at
+	// most 32 active features plus the bias, it stays within 33 * 1.98 * NNUEQA.
+	NNUEWeightClip float64 = 1.98
+
+	AdamBeta1   float64 = 0.9
+	AdamBeta2   float64 = 0.999
+	AdamEpsilon float64 = 1e-8
+
+	// The data's always split with the same seed, so training resumed from a
+	// checkpoint never validates on positions it has already trained on.
+	NNUESplitSeed int64 = 1
+
+	NNUECheckpointFile = "checkpoint.gob"
+	NNUEFinalNetFile   = "net.nnue"
+
+	nnueHidden = engine.NNUEHiddenSize
+
+	// Offsets of each layer's parameters into the flat parameter slice.
+	featureWeightsOffset = 0
+	featureBiasesOffset  = featureWeightsOffset + engine.NNUEInputSize*nnueHidden
+	outputWeightsOffset  = featureBiasesOffset + nnueHidden
+	outputBiasOffset     = outputWeightsOffset + 2*nnueHidden
+	numNNUEParams        = outputBiasOffset + 1
+)
+
+// A training position, stored as the inputs active from white's perspective. The
+// inputs from black's perspective are just those mirrored.
+type NNUEDatapoint struct {
+	Features    [32]uint16
+	NumFeatures uint8
+	Side        uint8
+
+	// The expected score of the side to move, from 0 to 1.
+	Target float64
+}
+
+func NewNNUEDatapoint(pos *engine.Position, target float64) NNUEDatapoint {
+	datapoint := NNUEDatapoint{Side: pos.Side, Target: target}
+	if pos.Side == engine.Black {
+		datapoint.Target = 1 - target
+	}
+
+	piecesBB := pos.Colors[engine.White] | pos.Colors[engine.Black]
+	for ; piecesBB != 0 && datapoint.NumFeatures < 32; piecesBB &= piecesBB - 1 {
+		sq := engine.GetLSBpos(piecesBB)
+		feature := engine.NNUEFeatureIndex(engine.White, pos.GetPieceTypeOnSq(sq), pos.GetPieceColorOnSq(sq), sq)
+		datapoint.Features[datapoint.NumFeatures] = uint16(feature)
+		datapoint.NumFeatures++
+	}
+
+	return datapoint
+}
+
+// Get the index of one of the datapoint's inputs from the given perspective.
+func (datapoint *NNUEDatapoint) feature(i int, perspective uint8) int {
+	feature := int(datapoint.Features[i])
+	if perspective == engine.White {
+		return feature
+	}
+
+	// Flip the square vertically, and swap whose piece it is.
+	feature ^= 56
+	if feature < 384 {
+		return feature + 384
+	}
+	return feature - 384
+}
+
+// Load training positions from a CSV file with a header naming its columns. A "fen"
+// and an "outcome" column are required, with outcomes from white's perspective (white
+// win=1.0, black win=0.0, draw=0.5), as written by the FEN extractor. If there's also
+// a "score" column, holding search scores in centi-pawns from white's perspective, the
+// target of each position blends the outcome with the score's win probability, giving
+// the outcome the weight wdlWeight. Files in the binary self-play format are read
+// as well, going by their extension.
+func LoadNNUEDatapoints(dataFile string, wdlWeight float64) []NNUEDatapoint {
+	file, err := os.Open(dataFile)
+	if err != nil {
+		panic(err)
+	}
+	defer file.Close()
+
+	if strings.HasSuffix(dataFile, datagen.PackedFileExtension) {
+		return loadPackedNNUEDatapoints(file, wdlWeight)
+	}
+
+	scanner := bufio.NewScanner(file)
+	if !scanner.Scan() {
+		panic("empty data file")
+	}
+
+	fenCol, outcomeCol, scoreCol := -1, -1, -1
+	for i, name := range strings.Split(scanner.Text(), ",") {
+		switch strings.TrimSpace(name) {
+		case "fen":
+			fenCol = i
+		case "outcome":
+			outcomeCol = i
+		case "score":
+			scoreCol = i
+		}
+	}
+
+	if fenCol < 0 || outcomeCol < 0 {
+		panic("data file needs a header with at least a fen and an outcome column")
+	}
+
+	datapoints := []NNUEDatapoint{}
+	pos := engine.Position{}
+
+	for scanner.Scan() {
+		fields := strings.Split(strings.TrimSpace(scanner.Text()), ",")
+		if len(fields) <= max(fenCol, outcomeCol, scoreCol) {
+			panic("malformed datapoint in data file")
+		}
+
+		target, err := strconv.ParseFloat(strings.TrimSpace(fields[outcomeCol]), 64)
+		if err != nil {
+			panic(err)
+		}
+
+		if scoreCol >= 0 {
+			score, err := strconv.ParseFloat(strings.TrimSpace(fields[scoreCol]), 64)
+			if err != nil {
+				panic(err)
+			}
+			target = wdlWeight*target + (1-wdlWeight)*sigmoid(K*score)
+		}
+
+		pos.LoadFEN(strings.TrimSpace(fields[fenCol]))
+		datapoints = append(datapoints, NewNNUEDatapoint(&pos, target))
+	}
+
+	if err := scanner.Err(); err != nil {
+		panic(err)
+	}
+
+	return datapoints
+}
+
+func loadPackedNNUEDatapoints(file *os.File, wdlWeight float64) []NNUEDatapoint {
+	datapoints := []NNUEDatapoint{}
+	reader := bufio.NewReader(file)
+	packed := make([]byte, datagen.PackedPositionSize)
+
+	for {
+		if _, err := io.ReadFull(reader, packed); err == io.EOF {
+			break
+		} else if err != nil {
+			panic(err)
+		}
+
+		position, outcome := datagen.UnpackPosition(packed)
+		target := wdlWeight*outcome + (1-wdlWeight)*sigmoid(K*float64(position.Score))
+		datapoints = append(datapoints, NewNNUEDatapoint(&position.Pos, target))
+	}
+
+	return datapoints
+}
+
+type NNUETrainerConfig struct {
+	DataFile  string
+	OutDir    string
+	WDLWeight float64
+
+	Epochs          int
+	BatchSize       int
+	LearningRate    float64
+	LRDropFactor    float64
+	LRDropEvery     int
+	ValidationSplit float64
+	CheckpointEvery int
+	NumThreads      int
+
+	// A checkpoint to resume training from, if not empty.
+	Resume string
+}
+
+// Everything needed to pick up training where it was left off, saved with gob.
+type NNUECheckpoint struct {
+	Epoch        int
+	Step         int
+	LearningRate float64
+	Params       []float64
+	AdamM        []float64
+	AdamV        []float64
+}
+
+type NNUETrainer struct {
+	config     NNUETrainerConfig
+	checkpoint NNUECheckpoint
+	gradients  [][]float64
+}
+
+func NewNNUETrainer(config NNUETrainerConfig) *NNUETrainer {
+	trainer := &NNUETrainer{config: config}
+
+	if config.Resume != "" {
+		trainer.loadCheckpoint(config.Resume)
+	} else {
+		trainer.randomize()
+	}
+
+	trainer.gradients = make([][]float64, config.NumThreads)
+	for i := range trainer.gradients {
+		trainer.gradients[i] = make([]float64, numNNUEParams)
+	}
+
+	return trainer
+}
+
+func (trainer *NNUETrainer) randomize() {
+	params := make([]float64, numNNUEParams)
+
+	// Scale the random weights by the number of inputs feeding each neuron, which is
+	// around 32 for the hidden layer, given how few inputs are active at once.
+	for i := featureWeightsOffset; i < featureBiasesOffset; i++ {
+		params[i] = genRandIntWithinSymmetricInterval(1 / math.Sqrt(32))
+	}
+	for i := outputWeightsOffset; i < outputBiasOffset; i++ {
+		params[i] = genRandIntWithinSymmetricInterval(1 / math.Sqrt(2*nnueHidden))
+	}
+
+	trainer.checkpoint = NNUECheckpoint{
+		LearningRate: trainer.config.LearningRate,
+		Params:       params,
+		AdamM:        make([]float64, numNNUEParams),
+		AdamV:        make([]float64, numNNUEParams),
+	}
+}
+
+// Train the network on the data file, holding out part of it to measure how well the
+// network generalizes, and write the final network into the output directory.
+func (trainer *NNUETrainer) Train() {
+	config := &trainer.config
+	if err := os.MkdirAll(config.OutDir, 0755); err != nil {
+		panic(err)
+	}
+
+	datapoints := LoadNNUEDatapoints(config.DataFile, config.WDLWeight)
+	splitRNG := rand.New(rand.NewSource(NNUESplitSeed))
+	splitRNG.Shuffle(len(datapoints), func(i, j int) { datapoints[i], datapoints[j] = datapoints[j], datapoints[i] })
+
+	numValidation := int(float64(len(datapoints)) * config.ValidationSplit)
+	validation := datapoints[:numValidation]
+	training := datapoints[numValidation:]
+	if len(training) == 0 {
+		panic("no datapoints left to train on")
+	}
+
+	fmt.Printf("Training on %d positions, validating on %d\n", len(training), len(validation))
+
+	for epoch := trainer.checkpoint.Epoch; epoch < config.Epochs; epoch++ {
+		start := time.Now()
+		rand.Shuffle(len(training), func(i, j int) { training[i], training[j] = training[j], training[i] })
+
+		trainingLoss := 0.0
+		for batchStart := 0; batchStart < len(training); batchStart += config.BatchSize {
+			batch := training[batchStart:min(batchStart+config.BatchSize, len(training))]
+			trainingLoss += trainer.trainBatch(batch) * float64(len(batch))
+		}
+		trainingLoss /= float64(len(training))
+
+		trainer.checkpoint.Epoch = epoch + 1
+		fmt.Printf(
+			"Epoch %d/%d: training loss %.6f, validation loss %s, learning rate %g, %.1fs\n",
+			epoch+1, config.Epochs, trainingLoss, trainer.validationLoss(validation),
+			trainer.checkpoint.LearningRate, time.Since(start).Seconds(),
+		)
+
+		if config.LRDropEvery > 0 && (epoch+1)%config.LRDropEvery == 0 {
+			trainer.checkpoint.LearningRate *= config.LRDropFactor
+		}
+
+		if config.CheckpointEvery > 0 && (epoch+1)%config.CheckpointEvery == 0 {
+			trainer.saveCheckpoint(filepath.Join(config.OutDir, NNUECheckpointFile))
+			trainer.Export(filepath.Join(config.OutDir, fmt.Sprintf("net-epoch%d.nnue", epoch+1)))
+		}
+	}
+
+	trainer.saveCheckpoint(filepath.Join(config.OutDir, NNUECheckpointFile))
+	trainer.Export(filepath.Join(config.OutDir, NNUEFinalNetFile))
+	fmt.Printf("Wrote the network to %s\n", filepath.Join(config.OutDir, NNUEFinalNetFile))
+}
+
+func (trainer *NNUETrainer) validationLoss(validation []NNUEDatapoint) string {
+	if len(validation) == 0 {
+		return "n/a"
+	}
+
+	losses := make([]float64, trainer.config.NumThreads)
+	trainer.parallelize(validation, func(thread int, datapoints []NNUEDatapoint) {
+		var activations [2][nnueHidden]float64
+		for i := range datapoints {
+			prediction := trainer.forward(&datapoints[i], &activations)
+			diff := prediction - datapoints[i].Target
+			losses[thread] += diff * diff
+		}
+	})
+
+	loss := 0.0
+	for _, threadLoss := range losses {
+		loss += threadLoss
+	}
+	return fmt.Sprintf("%.6f", loss/float64(len(validation)))
+}
+
+// Split the datapoints between the threads, and wait for them all to finish.
+func (trainer *NNUETrainer) parallelize(datapoints []NNUEDatapoint, work func(thread int, datapoints []NNUEDatapoint)) {
+	var wg sync.WaitGroup
+	numThreads := trainer.config.NumThreads
+	numDatapointsPerThread := (len(datapoints) + numThreads - 1) / numThreads
+
+	for i := 0; i < numThreads; i++ {
+		start := min(numDatapointsPerThread*i, len(datapoints))
+		end := min(numDatapointsPerThread*(i+1), len(datapoints))
+
+		wg.Add(1)
+		go func(thread int) {
+			defer wg.Done()
+			work(thread, datapoints[start:end])
+		}(i)
+	}
+
+	wg.Wait()
+}
+
+// Compute the hidden layer's activations for the side to move and the other side,
+// before clipping, and return the predicted score of the side to move.
+func (trainer *NNUETrainer) forward(datapoint *NNUEDatapoint, hidden *[2][nnueHidden]float64) float64 {
+	params := trainer.checkpoint.Params
+	perspectives := [2]uint8{datapoint.Side, datapoint.Side ^ 1}
+
+	output := params[outputBiasOffset]
+	for p, perspective := range perspectives {
+		copy(hidden[p][:], params[featureBiasesOffset:featureBiasesOffset+nnueHidden])
+		for i := 0; i < int(datapoint.NumFeatures); i++ {
+			weightsStart := featureWeightsOffset + datapoint.feature(i, perspective)*nnueHidden
+			weights := params[weightsStart : weightsStart+nnueHidden]
+			for j, weight := range weights {
+				hidden[p][j] += weight
+			}
+		}
+
+		outputWeights := params[outputWeightsOffset+p*nnueHidden : outputWeightsOffset+(p+1)*nnueHidden]
+		for j, weight := range outputWeights {
+			output += clip(hidden[p][j], 0, 1) * weight
+		}
+	}
+
+	return sigmoid(K * engine.NNUEScale * output)
+}
+
+// Run a mini-batch through the network, and update the parameters with Adam, using
+// the gradient of the mean squared error. Returns the batch's loss.
+func (trainer *NNUETrainer) trainBatch(batch []NNUEDatapoint) float64 {
+	params := trainer.checkpoint.Params
+	losses := make([]float64, trainer.config.NumThreads)
+
+	trainer.parallelize(batch, func(thread int, datapoints []NNUEDatapoint) {
+		gradients := trainer.gradients[thread]
+		clear(gradients)
+
+		var hidden [2][nnueHidden]float64
+		for i := range datapoints {
+			datapoint := &datapoints[i]
+			prediction := trainer.forward(datapoint, &hidden)
+			diff := prediction - datapoint.Target
+			losses[thread] += diff * diff
+
+			outputGradient := 2 * diff * prediction * (1 - prediction) * K * engine.NNUEScale
+			gradients[outputBiasOffset] += outputGradient
+
+			perspectives := [2]uint8{datapoint.Side, datapoint.Side ^ 1}
+			for p, perspective := range perspectives {
+				outputWeightsStart := outputWeightsOffset + p*nnueHidden
+
+				for j := 0; j < nnueHidden; j++ {
+					activation := hidden[p][j]
+					gradients[outputWeightsStart+j] += outputGradient * clip(activation, 0, 1)
+
+					// The clipped ReLU has no gradient outside of [0, 1].
+					if activation <= 0 || activation >= 1 {
+						hidden[p][j] = 0
+						continue
+					}
+
+					hiddenGradient := outputGradient * params[outputWeightsStart+j]
+					hidden[p][j] = hiddenGradient
+					gradients[featureBiasesOffset+j] += hiddenGradient
+				}
+
+				for i := 0; i < int(datapoint.NumFeatures); i++ {
+					weightsStart := featureWeightsOffset + datapoint.feature(i, perspective)*nnueHidden
+					weightGradients := gradients[weightsStart : weightsStart+nnueHidden]
+					for j := range weightGradients {
+						weightGradients[j] += hidden[p][j]
+					}
+				}
+			}
+		}
+	})
+
+	checkpoint := &trainer.checkpoint
+	checkpoint.Step++
+	biasCorrection1 := 1 - math.Pow(AdamBeta1, float64(checkpoint.Step))
+	biasCorrection2 := 1 - math.Pow(AdamBeta2, float64(checkpoint.Step))
+	N := float64(len(batch))
+
+	for i := 0; i < numNNUEParams; i++ {
+		gradient := 0.0
+		for _, threadGradients := range trainer.gradients {
+			gradient += threadGradients[i]
+		}
+		gradient /= N
+
+		checkpoint.AdamM[i] = AdamBeta1*checkpoint.AdamM[i] + (1-AdamBeta1)*gradient
+		checkpoint.AdamV[i] = AdamBeta2*checkpoint.AdamV[i] + (1-AdamBeta2)*gradient*gradient
+
+		m := checkpoint.AdamM[i] / biasCorrection1
+		v := checkpoint.AdamV[i] / biasCorrection2
+		params[i] -= checkpoint.LearningRate * m / (math.Sqrt(v) + AdamEpsilon)
+
+		if i < outputBiasOffset {
+			params[i] = clip(params[i], -NNUEWeightClip, NNUEWeightClip)
+		}
+	}
+
+	loss := 0.0
+	for _, threadLoss := range losses {
+		loss += threadLoss
+	}
+	return loss / N
+}
+
+// Quantize the network into the format the engine loads, and write it to the given
+// path.
+func (trainer *NNUETrainer) Export(path string) {
+	params := trainer.checkpoint.Params
+	net := &engine.NNUENetwork{}
+
+	for input := 0; input < engine.NNUEInputSize; input++ {
+		for j := 0; j < nnueHidden; j++ {
+			net.FeatureWeights[input][j] = quantize(params[featureWeightsOffset+input*nnueHidden+j], engine.NNUEQA)
+		}
+	}
+
+	for j := 0; j < nnueHidden; j++ {
+		net.FeatureBiases[j] = quantize(params[featureBiasesOffset+j], engine.NNUEQA)
+		net.OutputWeights[0][j] = quantize(params[outputWeightsOffset+j], engine.NNUEQB)
+		net.OutputWeights[1][j] = quantize(params[outputWeightsOffset+nnueHidden+j], engine.NNUEQB)
+	}
+
+	net.OutputBias = int32(math.Round(params[outputBiasOffset] * engine.NNUEQA * engine.NNUEQB))
+	net.Save(path)
+}
+
+func (trainer *NNUETrainer) saveCheckpoint(path string) {
+	// As with the tuner's checkpoints, write to a temporary file and move it over
+	// the previous checkpoint, so a crash while writing never loses the previous one.
+	tmpPath := path + ".tmp"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		panic(err)
+	}
+
+	writer := bufio.NewWriter(file)
+	if err := gob.NewEncoder(writer).Encode(&trainer.checkpoint); err != nil {
+		panic(err)
+	}
+	if err := writer.Flush(); err != nil {
+		panic(err)
+	}
+	if err := file.Sync(); err != nil {
+		panic(err)
+	}
+	if err := file.Close(); err != nil {
+		panic(err)
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		panic(err)
+	}
+}
+
+func (trainer *NNUETrainer) loadCheckpoint(path string) {
+	file, err := os.Open(path)
+	if err != nil {
+		panic(err)
+	}
+	defer file.Close()
+
+	checkpoint := NNUECheckpoint{}
+	if err := gob.NewDecoder(bufio.NewReader(file)).Decode(&checkpoint); err != nil {
+		panic(err)
+	}
+	if len(checkpoint.Params) != numNNUEParams {
+		panic(fmt.Sprintf("checkpoint has %d parameters, expected %d", len(checkpoint.Params), numNNUEParams))
+	}
+
+	trainer.checkpoint = checkpoint
+	fmt.Printf("Resuming from epoch %d\n", checkpoint.Epoch)
+}
+
+func quantize(value float64, scale float64) int16 {
+	return int16(clip(math.Round(value*scale), math.MinInt16, math.MaxInt16))
+}
+
+func clip(value, low, high float64) float64 {
+	return max(min(value, high), low)
+}
@@ -2,11 +2,14 @@ package tuner
 
 import (
 	"bufio"
+	"encoding/gob"
 	"eques/engine"
 	"fmt"
 	"math"
 	"math/rand"
 	"os"
+	"os/signal"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
@@ -27,11 +30,82 @@ const (
 	// Scaling factor so that the conversion from centi-pawns to a
 	// probability is more reasonable. E.g., we don't want 50 cp =>
 	// 0.99 probability, which is would using a unchanged sigmoid
-	// function.
+	// function. This is only the default, as the tuner fits K to the
+	// dataset before tuning.
 	K              float64 = 0.01
 	Epsilon        float64 = 0.00000001
+
+	// The interval searched for the K which best fits the data, and how
+	// narrow the interval should be before the search stops.
+	KSearchMin       float64 = 0
+	KSearchMax       float64 = 0.1
+	KSearchTolerance float64 = 0.000001
+
+	// The optimizers which can be used to apply the gradient.
+	AdaGrad = "adagrad"
+	Adam    = "adam"
+	SGD     = "sgd"
+
+	// The seed used to split the data into training and validation sets, so the
+	// split is the same between runs on the same data.
+	ValidationSplitSeed int64 = 1
 )
 
+type TunerConfig struct {
+	DataFile string
+
+	// The scaling constant to use, or zero to fit it to the data.
+	K float64
+
+	Optimizer    string
+	LearningRate float64
+	// The momentum used by SGD.
+	Momentum float64
+	// How much the learning rate is multiplied by after each iteration.
+	LRDecay float64
+	// The number of datapoints in each mini-batch, or zero to compute the gradient
+	// over every datapoint at once.
+	BatchSize int
+
+	// The number of iterations, each of which is a full pass over the data.
+	Iterations        int
+	NumThreads        int
+	RecordErrEveryNth int
+
+	// The fraction of the data held out to measure the validation error.
+	ValidationSplit float64
+	// How many recordings of the error the validation error can go without
+	// improving before tuning stops early, or zero to never stop early.
+	Patience int
+
+	// Where to save checkpoints, and how many iterations apart, or zero to only
+	// save one when tuning finishes, stops early, or is interrupted.
+	CheckpointFile  string
+	CheckpointEvery int
+	// A checkpoint to resume tuning from, if not empty.
+	Resume string
+}
+
+// Everything needed to pick up tuning where it was left off, saved with gob.
+type TunerCheckpoint struct {
+	Iteration    int
+	K            float64
+	LearningRate float64
+	Optimizer    string
+	Weights      []float64
+
+	SumOfGradientsSquared []float64
+	AdamM                 []float64
+	AdamV                 []float64
+	AdamStep              int
+	Velocity              []float64
+
+	BestValidationErr            float64
+	BestWeights                  []float64
+	RecordingsWithoutImprovement int
+	Errors                       [][]float64
+}
+
 var BasePieceValues = [6]float64{
 	BasePawnCPValue,
 	BaseBishopCPValue,
@@ -50,67 +124,54 @@ func sigmoid(x float64) float64 {
 }
 
 func evaluatePosition(weights *Weights, pos *Datapoint) (score float64) {
-	for _, piece := range pos.Pieces {
-		score += float64(piece.Sign) * weights.weights[piece.WeightIdx]
+	egPhase := 1 - pos.MGPhase
+	for _, coefficient := range pos.Coefficients {
+		mgScore := weights.weights[coefficient.WeightIdx]
+		egScore := weights.weights[weights.egOffset+int(coefficient.WeightIdx)]
+		score += coefficient.Value * (mgScore*pos.MGPhase + egScore*egPhase)
 	}
 	return score
 }
 
-func convertFloatSiceToInt(slice []float64) (ints []int16) {
-	for _, float := range slice {
-		ints = append(ints, int16(float))
-	}
-	return ints
-}
-
-func prettyPrintPSQT(name string, psqt []int16) {
-	fmt.Print("{\n")
-	fmt.Print("    // ", name, "\n    ")
-	for sq := 0; sq < 64; sq++ {
-		if sq > 0 && sq%8 == 0 {
-			fmt.Print("\n    ")
-		}
-		fmt.Printf("%3d, ", psqt[sq])
-	}
-	fmt.Print("\n},\n")
-}
-
-type Piece struct {
+// How much a weight contributes to the evaluation of a datapoint, from white's
+// perspective. Only weights with a non-zero coefficient are stored.
+type Coefficient struct {
 	WeightIdx uint16
-	Sign      int8
+	Value     float64
 }
 
 type Datapoint struct {
-	Outcome  float64 
-	Pieces   []Piece
+	Outcome      float64
+	MGPhase      float64
+	Coefficients []Coefficient
 }
 
-func NewDatapoint(pos *engine.Position, outcome float64) Datapoint {
+// Create a datapoint from the position, with the coefficients of every feature set's
+// weights. The coefficients slice is scratch space, with a coefficient for each weight.
+func NewDatapoint(pos *engine.Position, outcome float64, weights *Weights, coefficients []float64) Datapoint {
 	datapoint := Datapoint{}
 	datapoint.Outcome = outcome
 
-	piecesBB := pos.Colors[engine.White] | pos.Colors[engine.Black]
+	phase := min(pos.Phase, engine.TotalPhase)
+	datapoint.MGPhase = float64(phase) / float64(engine.TotalPhase)
 
-	for piecesBB != 0 {
-		sq := engine.GetLSBpos(piecesBB)
-		pieceType := pos.GetPieceTypeOnSq(sq)
-		pieceColor := pos.GetPieceColorOnSq(sq)
-		
+	clear(coefficients)
+	trace := engine.TraceCoefficients(pos)
+	for i, featureSet := range weights.featureSets {
+		start := weights.offsets[i]
+		featureSet.Extract(pos, &trace, coefficients[start:start+featureSet.Size()])
+	}
 
-		weightIdx := uint16(pieceType)*64 + uint16(engine.FlipSq[pieceColor][sq])
-		sign := int8(1)
-		if pieceColor == engine.Black {
-			sign = -1
+	for weightIdx, value := range coefficients {
+		if value != 0 {
+			datapoint.Coefficients = append(datapoint.Coefficients, Coefficient{uint16(weightIdx), value})
 		}
-
-		datapoint.Pieces = append(datapoint.Pieces, Piece{WeightIdx: weightIdx, Sign: sign})
-		piecesBB &= (piecesBB - 1)
 	}
 
 	return datapoint
 }
 
-func loadDatapoints(fenFilePath string) (datapoints []Datapoint) {
+func loadDatapoints(fenFilePath string, weights *Weights) (datapoints []Datapoint) {
 	dataFile, err := os.OpenFile(fenFilePath, os.O_RDONLY, 0644)
 	if err != nil {
 		panic(err)
@@ -121,21 +182,32 @@ func loadDatapoints(fenFilePath string) (datapoints []Datapoint) {
 	scanner := bufio.NewScanner(dataFile)
 	datapoints = []Datapoint{}
 	pos := engine.Position{}
+	coefficients := make([]float64, weights.egOffset)
 
-	// Skip the CSV header
+	// Skip the CSV header, but find the fen and outcome columns in it, since
+	// self-play data also has a score column.
 	scanner.Scan()
+	fenCol, outcomeCol := 0, 1
+	for i, name := range strings.Split(scanner.Text(), ",") {
+		switch strings.TrimSpace(name) {
+		case "fen":
+			fenCol = i
+		case "outcome":
+			outcomeCol = i
+		}
+	}
 
 	for scanner.Scan() {
 		line := scanner.Text()
 		line = strings.TrimSpace(line)
 		fields := strings.Split(line, ",")
 
-		if len(fields) != 2 {
+		if len(fields) <= max(fenCol, outcomeCol) {
 			panic("malformed datapoint in data file")
 		}
 
-		fenField := strings.TrimSpace(fields[0])
-		outcomeField := strings.TrimSpace(fields[1])
+		fenField := strings.TrimSpace(fields[fenCol])
+		outcomeField := strings.TrimSpace(fields[outcomeCol])
 
 		pos.LoadFEN(fenField)
 		outcome, err := strconv.ParseFloat(outcomeField, 64)
@@ -144,85 +216,170 @@ func loadDatapoints(fenFilePath string) (datapoints []Datapoint) {
 			panic(err)
 		}
 
-		datapoints = append(datapoints, NewDatapoint(&pos, outcome))
+		datapoints = append(datapoints, NewDatapoint(&pos, outcome, weights, coefficients))
 	}
 
 	return datapoints
 }
 
+// The weights of every feature set, laid out one set after the other. All of the
+// middlegame weights come first, and the endgame weights right after them.
 type Weights struct {
-	weights               [NumPSQTWeights]float64
-	sumOfGradientsSquared [NumPSQTWeights]float64
+	featureSets           []FeatureSet
+	offsets               []int
+	egOffset              int
+	weights               []float64
+	k                     float64
+
+	// The state of the optimizers: the sum of squared gradients for AdaGrad, the
+	// moments and step count for Adam, and the velocity for SGD with momentum.
+	sumOfGradientsSquared []float64
+	adamM                 []float64
+	adamV                 []float64
+	adamStep              int
+	velocity              []float64
+}
+
+func NewWeights(featureSets []FeatureSet) *Weights {
+	weights := &Weights{featureSets: featureSets, k: K}
+	for _, featureSet := range featureSets {
+		weights.offsets = append(weights.offsets, weights.egOffset)
+		weights.egOffset += featureSet.Size()
+	}
+
+	weights.weights = make([]float64, 2*weights.egOffset)
+	weights.sumOfGradientsSquared = make([]float64, 2*weights.egOffset)
+	weights.adamM = make([]float64, 2*weights.egOffset)
+	weights.adamV = make([]float64, 2*weights.egOffset)
+	weights.velocity = make([]float64, 2*weights.egOffset)
+	return weights
+}
+
+// Get the middlegame and endgame weights of one of the feature sets.
+func (weights *Weights) featureSetWeights(i int) (mg, eg []float64) {
+	start := weights.offsets[i]
+	end := start + weights.featureSets[i].Size()
+	return weights.weights[start:end], weights.weights[weights.egOffset+start : weights.egOffset+end]
 }
 
 func (weights *Weights) Randomize() {
+	weights.LoadBaseWeights()
 	for pieceType := engine.Pawn; pieceType < engine.NoType; pieceType++ {
-		baseValue := BasePieceValues[pieceType]
 		startIdx := pieceType*64
 
 		for sq := 0; sq < 64; sq++ {
-			value := baseValue + genRandIntWithinSymmetricInterval(RandomDeltaBound)
-			weights.weights[startIdx+sq] = value
+			weights.weights[startIdx+sq] += genRandIntWithinSymmetricInterval(RandomDeltaBound)
+			weights.weights[weights.egOffset+startIdx+sq] += genRandIntWithinSymmetricInterval(RandomDeltaBound)
 		}
 	}
 }
 
+// Start the piece-square tables from the base piece values, and every other
+// weight from zero.
 func (weights *Weights) LoadBaseWeights() {
+	clear(weights.weights)
 	for pieceType := engine.Pawn; pieceType < engine.NoType; pieceType++ {
 		baseValue := BasePieceValues[pieceType]
 		startIdx := pieceType*64
 		for sq := 0; sq < 64; sq++ {
 			weights.weights[startIdx+sq] = baseValue
+			weights.weights[weights.egOffset+startIdx+sq] = baseValue
 		}
 	}
 }
 
-func (weights *Weights) LoadWeights(PSQT [6][64]int16) {
+// Start every weight from the value the engine currently uses.
+func (weights *Weights) LoadEngineWeights() {
+	for i, featureSet := range weights.featureSets {
+		featureSet.Load(weights.featureSetWeights(i))
+	}
+}
+
+func (weights *Weights) LoadWeights(mgPSQT, egPSQT [6][64]int16) {
 	for pieceType := engine.Pawn; pieceType < engine.NoType; pieceType++ {
 		startIdx := pieceType*64
 		for sq := 0; sq < 64; sq++ {
-			weights.weights[startIdx+sq] = float64(PSQT[pieceType][sq])
+			weights.weights[startIdx+sq] = float64(mgPSQT[pieceType][sq])
+			weights.weights[weights.egOffset+startIdx+sq] = float64(egPSQT[pieceType][sq])
 		}
 	}
 }
 
-func (weights *Weights) CopyWeights(PSQT *[6][64]int16) {
+func (weights *Weights) CopyWeights(mgPSQT, egPSQT *[6][64]int16) {
 	for pieceType := engine.Pawn; pieceType < engine.NoType; pieceType++ {
 		startIdx := pieceType*64
 		for sq := 0; sq < 64; sq++ {
-			PSQT[pieceType][sq] = int16(weights.weights[startIdx+sq])
+			mgPSQT[pieceType][sq] = int16(weights.weights[startIdx+sq])
+			egPSQT[pieceType][sq] = int16(weights.weights[weights.egOffset+startIdx+sq])
 		}
 	}
 }
 
-func (weights *Weights) ComputeMSE(w *Weights, d []Datapoint) (sum float64) {
+func (weights *Weights) ComputeMSE(w *Weights, d []Datapoint) float64 {
+	return w.computeMSEWithK(d, w.k)
+}
+
+func (weights *Weights) computeMSEWithK(d []Datapoint, k float64) (sum float64) {
 	for i := 0; i < len(d); i++ {
 		datapoint := &d[i]
-		y_hat := sigmoid(K*evaluatePosition(w, datapoint))
+		y_hat := sigmoid(k*evaluatePosition(weights, datapoint))
 		diff := datapoint.Outcome - y_hat
 		sum += diff * diff
 	}
 	return sum / float64(len(d))
 }
 
+// Find the K which minimizes the mean-square error of the current weights, using a
+// golden-section search. The error is unimodal in K, since too small a K squashes
+// every prediction towards a draw, and too large a K makes every prediction
+// overconfident.
+func (weights *Weights) FitK(datapoints []Datapoint) float64 {
+	invPhi := (math.Sqrt(5) - 1) / 2
+	lo, hi := KSearchMin, KSearchMax
+
+	k1 := hi - invPhi*(hi-lo)
+	k2 := lo + invPhi*(hi-lo)
+	err1 := weights.computeMSEWithK(datapoints, k1)
+	err2 := weights.computeMSEWithK(datapoints, k2)
+
+	for hi-lo > KSearchTolerance {
+		if err1 < err2 {
+			hi, k2, err2 = k2, k1, err1
+			k1 = hi - invPhi*(hi-lo)
+			err1 = weights.computeMSEWithK(datapoints, k1)
+		} else {
+			lo, k1, err1 = k1, k2, err2
+			k2 = lo + invPhi*(hi-lo)
+			err2 = weights.computeMSEWithK(datapoints, k2)
+		}
+	}
+
+	return (lo + hi) / 2
+}
+
 func (weights *Weights) computePartialGradient(datapoints []Datapoint, partials chan []float64, wg *sync.WaitGroup) {
 	defer wg.Done()
 	gradients := make([]float64, len(weights.weights))
 
 	for i := 0; i < len(datapoints); i++ {
 		datapoint := &datapoints[i]
-		y_hat := sigmoid(K*evaluatePosition(weights, datapoint))
+		y_hat := sigmoid(weights.k*evaluatePosition(weights, datapoint))
 		term := (datapoint.Outcome - y_hat) * y_hat * (1 - y_hat)
 
-		for _, piece := range datapoint.Pieces {
-			gradients[piece.WeightIdx] += term * float64(piece.Sign)
+		mgTerm := term * datapoint.MGPhase
+		egTerm := term * (1 - datapoint.MGPhase)
+
+		for _, coefficient := range datapoint.Coefficients {
+			gradients[coefficient.WeightIdx] += mgTerm * coefficient.Value
+			gradients[weights.egOffset+int(coefficient.WeightIdx)] += egTerm * coefficient.Value
 		}
 	}
 
 	partials <- gradients
 }
 
-func (weights *Weights) computeAndApplyGradient(learningRate float64, numThreads int, datapoints []Datapoint) {
+// Compute the gradient of the mean-square error over the datapoints.
+func (weights *Weights) computeGradient(numThreads int, datapoints []Datapoint) []float64 {
 	var wg sync.WaitGroup
 	partials := make(chan []float64, numThreads)
 
@@ -255,58 +412,298 @@ func (weights *Weights) computeAndApplyGradient(learningRate float64, numThreads
 	}
 
 	N := float64(len(datapoints))
-	leadingCoeff := (-2 * K) / N
+	leadingCoeff := (-2 * weights.k) / N
 
 	for i := 0; i < len(gradients); i++ {
-		finalGradient := leadingCoeff * gradients[i]
-		weights.sumOfGradientsSquared[i] += finalGradient * finalGradient
-		sqrtTerm := math.Sqrt(weights.sumOfGradientsSquared[i]+Epsilon)
-		weights.weights[i] -= learningRate * finalGradient / sqrtTerm
+		gradients[i] *= leadingCoeff
+	}
+
+	return gradients
+}
+
+// Take a step against the gradient, using the given optimizer.
+func (weights *Weights) applyGradient(config *TunerConfig, learningRate float64, gradients []float64) {
+	switch config.Optimizer {
+	case AdaGrad:
+		for i, gradient := range gradients {
+			weights.sumOfGradientsSquared[i] += gradient * gradient
+			sqrtTerm := math.Sqrt(weights.sumOfGradientsSquared[i]+Epsilon)
+			weights.weights[i] -= learningRate * gradient / sqrtTerm
+		}
+	case Adam:
+		weights.adamStep++
+		biasCorrection1 := 1 - math.Pow(AdamBeta1, float64(weights.adamStep))
+		biasCorrection2 := 1 - math.Pow(AdamBeta2, float64(weights.adamStep))
+
+		for i, gradient := range gradients {
+			weights.adamM[i] = AdamBeta1*weights.adamM[i] + (1-AdamBeta1)*gradient
+			weights.adamV[i] = AdamBeta2*weights.adamV[i] + (1-AdamBeta2)*gradient*gradient
+
+			m := weights.adamM[i] / biasCorrection1
+			v := weights.adamV[i] / biasCorrection2
+			weights.weights[i] -= learningRate * m / (math.Sqrt(v) + AdamEpsilon)
+		}
+	case SGD:
+		for i, gradient := range gradients {
+			weights.velocity[i] = config.Momentum*weights.velocity[i] - learningRate*gradient
+			weights.weights[i] += weights.velocity[i]
+		}
+	default:
+		panic(fmt.Sprintf("unknown optimizer \"%s\"", config.Optimizer))
 	}
 }
 
+// Make a full pass over the datapoints, taking a step for each mini-batch. The
+// datapoints are shuffled first, so the mini-batches differ between iterations.
+func (weights *Weights) runIteration(config *TunerConfig, learningRate float64, datapoints []Datapoint) {
+	batchSize := config.BatchSize
+	if batchSize <= 0 || batchSize >= len(datapoints) {
+		weights.applyGradient(config, learningRate, weights.computeGradient(config.NumThreads, datapoints))
+		return
+	}
+
+	rand.Shuffle(len(datapoints), func(i, j int) { datapoints[i], datapoints[j] = datapoints[j], datapoints[i] })
+	for start := 0; start < len(datapoints); start += batchSize {
+		batch := datapoints[start:min(start+batchSize, len(datapoints))]
+		weights.applyGradient(config, learningRate, weights.computeGradient(config.NumThreads, batch))
+	}
+}
+
+// Print the weights of every feature set as Go source, ready to replace the
+// definitions in the engine package.
 func (weights *Weights) DisplayWeights() {
-	prettyPrintPSQT("Pawn PST", convertFloatSiceToInt(weights.weights[0:64]))
-	prettyPrintPSQT("Knight PST", convertFloatSiceToInt(weights.weights[64:128]))
-	prettyPrintPSQT("Bishop PST", convertFloatSiceToInt(weights.weights[128:192]))
-	prettyPrintPSQT("Rook PST", convertFloatSiceToInt(weights.weights[192:256]))
-	prettyPrintPSQT("Queen PST", convertFloatSiceToInt(weights.weights[256:320]))
-	prettyPrintPSQT("King PST", convertFloatSiceToInt(weights.weights[320:384]))
+	for i, featureSet := range weights.featureSets {
+		fmt.Println(featureSet.Format(weights.featureSetWeights(i)))
+	}
 }
 
-func (weights *Weights) TuneWeights(dataFile string, learningRate float64, iterations, numThreads, recordErrEveryNth int) {
-	datapoints := loadDatapoints(dataFile)
-	weights.sumOfGradientsSquared = [NumPSQTWeights]float64{}
+// Split the datapoints into a training set, and a validation set holding out the
+// given fraction of them.
+func splitDatapoints(datapoints []Datapoint, validationSplit float64) (training, validation []Datapoint) {
+	splitRNG := rand.New(rand.NewSource(ValidationSplitSeed))
+	splitRNG.Shuffle(len(datapoints), func(i, j int) { datapoints[i], datapoints[j] = datapoints[j], datapoints[i] })
 
-	beforeErr := weights.ComputeMSE(weights, datapoints)
-	errors := []float64{beforeErr}
+	numValidation := int(float64(len(datapoints)) * validationSplit)
+	return datapoints[numValidation:], datapoints[:numValidation]
+}
 
-	for i := 0; i < iterations; i++ {
-		weights.computeAndApplyGradient(learningRate, numThreads, datapoints)
-		fmt.Printf("Completed iteration %d/%d\n", i+1, iterations)
-		
-		if i > 0 && i % recordErrEveryNth == 0 {
-			errors = append(errors, weights.ComputeMSE(weights, datapoints))
-		}
+// Compute the training error, and the validation error if any data was held out.
+func (weights *Weights) computeErrors(training, validation []Datapoint) []float64 {
+	errors := []float64{weights.ComputeMSE(weights, training)}
+	if len(validation) > 0 {
+		errors = append(errors, weights.ComputeMSE(weights, validation))
 	}
+	return errors
+}
 
-	errors = append(errors, weights.ComputeMSE(weights, datapoints))
+func writeErrors(errors [][]float64) {
 	file, err := os.Create("errors.txt")
 	if err != nil {
 		fmt.Println("Couldn't create \"errors.txt\" to store recored error rates")
-	} else {
-		fmt.Println("Storing error rates in errors.txt")
+		return
 	}
 
-	for _, err := range errors {
-		_, e := file.WriteString(fmt.Sprintf("%f\n", err))
+	defer file.Close()
+	fmt.Println("Storing error rates in errors.txt")
+
+	for _, recording := range errors {
+		values := make([]string, len(recording))
+		for i, err := range recording {
+			values[i] = fmt.Sprintf("%f", err)
+		}
+
+		_, e := file.WriteString(strings.Join(values, ",") + "\n")
 		if e != nil {
 			panic(e)
 		}
 	}
+}
+
+func (weights *Weights) saveCheckpoint(path string, checkpoint *TunerCheckpoint) {
+	checkpoint.K = weights.k
+	checkpoint.Weights = weights.weights
+	checkpoint.SumOfGradientsSquared = weights.sumOfGradientsSquared
+	checkpoint.AdamM = weights.adamM
+	checkpoint.AdamV = weights.adamV
+	checkpoint.AdamStep = weights.adamStep
+	checkpoint.Velocity = weights.velocity
+
+	// Write the checkpoint to a temporary file first, and only then move it over the
+	// previous checkpoint, so a crash while writing never loses the previous one.
+	tmpPath := path + ".tmp"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		panic(err)
+	}
 
-	fmt.Println("Before MSE:", beforeErr)
-	fmt.Println("After MSE:", weights.ComputeMSE(weights, datapoints))
+	writer := bufio.NewWriter(file)
+	if err := gob.NewEncoder(writer).Encode(checkpoint); err != nil {
+		panic(err)
+	}
+	if err := writer.Flush(); err != nil {
+		panic(err)
+	}
+	if err := file.Sync(); err != nil {
+		panic(err)
+	}
+	if err := file.Close(); err != nil {
+		panic(err)
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		panic(err)
+	}
+}
+
+func (weights *Weights) loadCheckpoint(path string) (checkpoint TunerCheckpoint) {
+	file, err := os.Open(path)
+	if err != nil {
+		panic(err)
+	}
+	defer file.Close()
+
+	if err := gob.NewDecoder(bufio.NewReader(file)).Decode(&checkpoint); err != nil {
+		panic(err)
+	}
+	if len(checkpoint.Weights) != len(weights.weights) {
+		panic(fmt.Sprintf("checkpoint has %d weights, expected %d", len(checkpoint.Weights), len(weights.weights)))
+	}
+
+	weights.k = checkpoint.K
+	copy(weights.weights, checkpoint.Weights)
+	copy(weights.sumOfGradientsSquared, checkpoint.SumOfGradientsSquared)
+	copy(weights.adamM, checkpoint.AdamM)
+	copy(weights.adamV, checkpoint.AdamV)
+	weights.adamStep = checkpoint.AdamStep
+	copy(weights.velocity, checkpoint.Velocity)
+	return checkpoint
+}
+
+// Tune the weights on the config's data file. If the config's K isn't positive, the
+// K which best fits the starting weights is found and used instead. Interrupting
+// tuning finishes the current iteration, saves a checkpoint, and displays the
+// weights tuned so far.
+func (weights *Weights) TuneWeights(config TunerConfig) {
+	if config.Optimizer != AdaGrad && config.Optimizer != Adam && config.Optimizer != SGD {
+		panic(fmt.Sprintf("unknown optimizer \"%s\"", config.Optimizer))
+	}
+
+	// The error is recorded every RecordErrEveryNth iterations, and early stopping
+	// is checked whenever it is.
+	if config.RecordErrEveryNth <= 0 {
+		panic(fmt.Sprintf("the error must be recorded every positive number of iterations, not %d", config.RecordErrEveryNth))
+	}
+
+	// Some data has to be left to train on.
+	if config.ValidationSplit < 0 || config.ValidationSplit >= 1 {
+		panic(fmt.Sprintf("validation split %v isn't within [0, 1)", config.ValidationSplit))
+	}
+
+	datapoints := loadDatapoints(config.DataFile, weights)
+	training, validation := splitDatapoints(datapoints, config.ValidationSplit)
+	if len(training) == 0 {
+		panic("no datapoints to train on")
+	}
+	fmt.Printf("Training on %d positions, validating on %d\n", len(training), len(validation))
+
+	var checkpoint TunerCheckpoint
+	if config.Resume != "" {
+		checkpoint = weights.loadCheckpoint(config.Resume)
+		if checkpoint.Optimizer != config.Optimizer {
+			panic(fmt.Sprintf("checkpoint was tuned with the %s optimizer, not %s", checkpoint.Optimizer, config.Optimizer))
+		}
+		fmt.Printf("Resuming from iteration %d\n", checkpoint.Iteration)
+		fmt.Println("Using K:", weights.k)
+	} else {
+		clear(weights.sumOfGradientsSquared)
+		clear(weights.adamM)
+		clear(weights.adamV)
+		clear(weights.velocity)
+		weights.adamStep = 0
+
+		if config.K > 0 {
+			weights.k = config.K
+			fmt.Println("Using K:", weights.k)
+		} else {
+			weights.k = weights.FitK(training)
+			fmt.Println("Fitted K:", weights.k)
+		}
+
+		// The weights with the lowest validation error are kept, so they can be
+		// restored if tuning stops early.
+		beforeErrors := weights.computeErrors(training, validation)
+		checkpoint = TunerCheckpoint{
+			LearningRate:      config.LearningRate,
+			Optimizer:         config.Optimizer,
+			BestValidationErr: math.Inf(1),
+			BestWeights:       slices.Clone(weights.weights),
+			Errors:            [][]float64{beforeErrors},
+		}
+		if len(validation) > 0 {
+			checkpoint.BestValidationErr = beforeErrors[1]
+		}
+	}
+
+	// The errors before tuning started, even when resuming.
+	beforeErrors := checkpoint.Errors[0]
+
+	interrupted := make(chan os.Signal, 1)
+	signal.Notify(interrupted, os.Interrupt)
+	defer signal.Stop(interrupted)
+
+	for i := checkpoint.Iteration; i < config.Iterations; i++ {
+		weights.runIteration(&config, checkpoint.LearningRate, training)
+		checkpoint.LearningRate *= config.LRDecay
+		checkpoint.Iteration = i + 1
+		fmt.Printf("Completed iteration %d/%d\n", i+1, config.Iterations)
+		
+		stop := false
+		if i > 0 && i % config.RecordErrEveryNth == 0 {
+			recording := weights.computeErrors(training, validation)
+			checkpoint.Errors = append(checkpoint.Errors, recording)
+
+			if len(validation) > 0 && config.Patience > 0 {
+				if recording[1] < checkpoint.BestValidationErr {
+					checkpoint.BestValidationErr = recording[1]
+					copy(checkpoint.BestWeights, weights.weights)
+					checkpoint.RecordingsWithoutImprovement = 0
+				} else if checkpoint.RecordingsWithoutImprovement++; checkpoint.RecordingsWithoutImprovement >= config.Patience {
+					fmt.Printf("Validation error hasn't improved in %d recordings, stopping early\n", config.Patience)
+					copy(weights.weights, checkpoint.BestWeights)
+					stop = true
+				}
+			}
+		}
+
+		select {
+		case <-interrupted:
+			fmt.Println("Interrupted, saving a checkpoint to", config.CheckpointFile)
+			stop = true
+		default:
+			if config.CheckpointEvery > 0 && (i+1)%config.CheckpointEvery == 0 {
+				weights.saveCheckpoint(config.CheckpointFile, &checkpoint)
+			}
+		}
+
+		if stop {
+			break
+		}
+	}
+
+	// Always save a final checkpoint, so resuming a finished run doesn't repeat
+	// the iterations since the last periodic one, and an early stop keeps the
+	// best weights.
+	weights.saveCheckpoint(config.CheckpointFile, &checkpoint)
+
+	afterErrors := weights.computeErrors(training, validation)
+	writeErrors(append(checkpoint.Errors, afterErrors))
+
+	fmt.Println("Before MSE:", beforeErrors[0])
+	fmt.Println("After MSE:", afterErrors[0])
+	if len(validation) > 0 {
+		fmt.Println("Before validation MSE:", beforeErrors[1])
+		fmt.Println("After validation MSE:", afterErrors[1])
+	}
 
 	weights.DisplayWeights()
 }
@@ -2,12 +2,21 @@ import matplotlib.pyplot as plt
 import os
 
 error_file_path = os.path.join(os.path.dirname(os.getcwd()), 'eques', 'errors.txt')
-error_rates = []
+training_error_rates = []
+validation_error_rates = []
 
+# Each line holds the training error, followed by the validation error if
+# any data was held out.
 with open(error_file_path, 'r') as infile:
     for line in infile:
-        error_rates.append(float(line.strip('\n')))
+        errors = [float(err) for err in line.strip('\n').split(',')]
+        training_error_rates.append(errors[0])
+        if len(errors) > 1:
+            validation_error_rates.append(errors[1])
 
-steps = list(range(1, len(error_rates)+1))
-plt.plot(steps, error_rates)
+steps = list(range(1, len(training_error_rates)+1))
+plt.plot(steps, training_error_rates, label='Training')
+if validation_error_rates:
+    plt.plot(steps, validation_error_rates, label='Validation')
+plt.legend()
 plt.show()
@@ -7,11 +7,25 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"time"
 )
 
 const (
 	EngineName = "Eques 1.0.0"
 	EngineAuthor = "Christian Dean"
+
+	MinTTSize = 1
+	MaxTTSize = 32768
+
+	PonderPollInterval = 5 * time.Millisecond
+
+	DefaultMultiPV = 1
+	MinMultiPV     = 1
+	MaxMultiPV     = 256
+
+	DefaultNumThreads = 1
+	MinNumThreads     = 1
+	MaxNumThreads     = 256
 )
 
 type GameData struct {
@@ -36,6 +50,10 @@ func (tq *TokensQueue) Pop() string {
 	return token
 }
 
+func (tq *TokensQueue) Peek() string {
+	return tq.tokens[0]
+}
+
 func (tq *TokensQueue) Size() int {
 	return len(tq.tokens)
 }
@@ -43,6 +61,23 @@ func (tq *TokensQueue) Size() int {
 func UCICommandReponse() {
 	fmt.Printf("id name %v\n", EngineName)
 	fmt.Printf("id author %v\n", EngineAuthor)
+	fmt.Printf(
+		"option name Hash type spin default %d min %d max %d\n",
+		engine.DefaultTTSize, MinTTSize, MaxTTSize,
+	)
+	fmt.Println("option name Clear Hash type button")
+	fmt.Println("option name Ponder type check default false")
+	fmt.Printf(
+		"option name MultiPV type spin default %d min %d max %d\n",
+		DefaultMultiPV, MinMultiPV, MaxMultiPV,
+	)
+	fmt.Printf(
+		"option name Threads type spin default %d min %d max %d\n",
+		DefaultNumThreads, MinNumThreads, MaxNumThreads,
+	)
+	fmt.Println("option name SyzygyPath type string default <empty>")
+	fmt.Println("option name EquesTBPath type string default <empty>")
+	fmt.Println("option name EvalFile type string default <empty>")
 	fmt.Println("uciok")
 }
 
@@ -50,8 +85,70 @@ func isReadyCommandReponse() {
 	fmt.Println("readyok")
 }
 
+func setOptionCommandReponse(sd *engine.SearchData, tokens *TokensQueue) {
+	name, value := parseOption(tokens)
+	switch strings.ToLower(name) {
+	case "hash":
+		size, ok := parseSpinValue(name, value)
+		if !ok {
+			return
+		}
+		if size < MinTTSize {
+			size = MinTTSize
+		} else if size > MaxTTSize {
+			size = MaxTTSize
+		}
+		sd.TT.Unitialize()
+		sd.TT.SetSize(uint64(size), engine.SearchEntrySize)
+	case "clear hash":
+		sd.TT.Clear()
+	case "ponder":
+		// Nothing to set up, since the GUI decides when to
+		// ponder by sending "go ponder".
+	case "multipv":
+		multiPV, ok := parseSpinValue(name, value)
+		if !ok {
+			return
+		}
+		if multiPV < MinMultiPV {
+			multiPV = MinMultiPV
+		} else if multiPV > MaxMultiPV {
+			multiPV = MaxMultiPV
+		}
+		sd.MultiPV = multiPV
+	case "threads":
+		numThreads, ok := parseSpinValue(name, value)
+		if !ok {
+			return
+		}
+		if numThreads < MinNumThreads {
+			numThreads = MinNumThreads
+		} else if numThreads > MaxNumThreads {
+			numThreads = MaxNumThreads
+		}
+		sd.SetNumThreads(numThreads)
+	case "syzygypath":
+		numTables := engine.InitSyzygy(value)
+		fmt.Printf("info string found %d tablebases\n", numTables)
+	case "equestbpath":
+		numTables := engine.InitDTMTablebases(value)
+		fmt.Printf("info string found %d distance to mate tablebases\n", numTables)
+	case "evalfile":
+		if err := engine.InitNNUE(value); err != nil {
+			fmt.Printf("info string failed to load network, using the classical evaluation: %s\n", err)
+		} else if engine.NNUEEnabled() {
+			fmt.Printf("info string using network %s\n", value)
+		} else {
+			fmt.Println("info string using the classical evaluation")
+		}
+	default:
+		fmt.Printf("info string unrecognized option \"%s\"\n", name)
+	}
+}
+
 func UCINewGameCommandReponse(sd *engine.SearchData, gd *GameData) {
 	sd.Reset()
+	sd.TT.Clear()
 	gd.Reset()
 	sd.Timer.Init()
 }
@@ -97,6 +194,8 @@ func goCommandReponse(sd *engine.SearchData, gd *GameData, tokens *TokensQueue)
 	timeLeft := int64(0)
 	timeInc := int64(0)
 	movesToGo := int64(0)
+	ponder := false
+	sd.Limits = engine.SearchLimits{}
 
 	for tokens.Size() > 0 {
 		token := tokens.Pop()
@@ -111,18 +210,77 @@ func goCommandReponse(sd *engine.SearchData, gd *GameData, tokens *TokensQueue)
 		case "movestogo":
 			movesToGo = int64(parseInt(tokens.Pop()))
 			timeFormat = engine.MovesToGoTimingFormat
+		case "movetime":
+			timeLeft = int64(parseInt(tokens.Pop()))
+			timeFormat = engine.FixedTimeFormat
 		case "infinite":
 			timeFormat = engine.InfiniteTimeFormat
+		case "ponder":
+			ponder = true
+		case "depth":
+			sd.Limits.Depth = uint8(min(max(parseInt(tokens.Pop()), 0), engine.MaxDepth))
+		case "nodes":
+			sd.Limits.Nodes = uint64(parseInt(tokens.Pop()))
+		case "mate":
+			sd.Limits.Mate = uint8(min(max(parseInt(tokens.Pop()), 0), engine.MaxDepth))
+		case "searchmoves":
+			for tokens.Size() > 0 && !isGoCommandKeyword(tokens.Peek()) {
+				sd.Limits.SearchMoves = append(sd.Limits.SearchMoves, parseUCIMove(sd, tokens.Pop()))
+			}
 		}
 	}
 
+	// Without any time controls given, search until told to stop, or
+	// until one of the other limits is reached.
+	if timeFormat == engine.NoFormat {
+		timeFormat = engine.InfiniteTimeFormat
+	}
+
 	sd.Timer.CalculateSearchTime(timeFormat, movesToGo, timeLeft, timeInc, gd.numOfMoves)
+	if ponder {
+		sd.Timer.StartPondering()
+	}
+
 	bestMove := engine.Search(sd)
-	fmt.Printf("bestmove %v\n", bestMove)
+
+	// The best move can't be sent while pondering, even if the search finished
+	// early, so wait until the GUI sends either "ponderhit" or "stop".
+	for sd.Timer.IsPondering() && !sd.Timer.Stopped.Load() {
+		time.Sleep(PonderPollInterval)
+	}
+
+	// A null move means there was nothing to play, which UCI reports as "0000".
+	pv := sd.GetCurrPV()
+	if bestMove == engine.NullMove {
+		fmt.Println("bestmove 0000")
+	} else if pv.Cnt >= 2 && pv.Moves[0].Equal(bestMove) {
+		fmt.Printf("bestmove %v ponder %v\n", bestMove, pv.Moves[1])
+	} else {
+		fmt.Printf("bestmove %v\n", bestMove)
+	}
+}
+
+func ponderHitCommandReponse(sd *engine.SearchData) {
+	sd.Timer.PonderHit()
+}
+
+func isGoCommandKeyword(token string) bool {
+	switch token {
+	case "wtime", "btime", "winc", "binc", "movestogo", "movetime",
+		"infinite", "depth", "nodes", "mate", "searchmoves", "ponder":
+		return true
+	}
+	return false
+}
+
+// Print a breakdown of the static evaluation of the current position. This isn't
+// part of the UCI protocol, but is useful for debugging the evaluation.
+func evalCommandReponse(sd *engine.SearchData) {
+	fmt.Print(engine.TraceEvaluation(&sd.Pos))
 }
 
 func stopCommandReponse(sd *engine.SearchData) {
-	sd.Timer.Stopped = true
+	sd.Timer.Stopped.Store(true)
 }
 
 func parseUCIMove(sd *engine.SearchData, move string) engine.Move {
@@ -171,6 +329,40 @@ func parseUCIMove(sd *engine.SearchData, move string) engine.Move {
 	return engine.NewMove(fromSq, toSq, pieceType, moveType)
 }
 
+// Parse the name and value of an option from the tokens of a setoption command, e.g.
+// "setoption name Clear Hash" or "setoption name Hash value 128". Both the name and the
+// value may contain spaces, so every token up to the next keyword is part of the field.
+func parseOption(tokens *TokensQueue) (name, value string) {
+	nameTokens := []string{}
+	valueTokens := []string{}
+	current := &nameTokens
+
+	for tokens.Size() > 0 {
+		token := tokens.Pop()
+		switch token {
+		case "name":
+			current = &nameTokens
+		case "value":
+			current = &valueTokens
+		default:
+			*current = append(*current, token)
+		}
+	}
+
+	return strings.Join(nameTokens, " "), strings.Join(valueTokens, " ")
+}
+
+// Parse the value of a spin option. An invalid value is reported to the GUI, and the
+// option left unchanged, rather than taking the engine down.
+func parseSpinValue(name, value string) (int, bool) {
+	val, err := strconv.Atoi(value)
+	if err != nil {
+		fmt.Printf("info string invalid value \"%s\" for option \"%s\"\n", value, name)
+		return 0, false
+	}
+	return val, true
+}
+
 func parseInt(intAsStr string) int {
 	val, err := strconv.Atoi(intAsStr)
 	if err != nil {
@@ -199,6 +391,7 @@ func StartUCIProtocolInterface() {
 	gameData := GameData{}
 
 	UCICommandReponse()
+	searchData.TT.SetSize(engine.DefaultTTSize, engine.SearchEntrySize)
 	searchData.Pos.LoadFEN(engine.FENStartPosition)
 	searchData.AddCurrPosToHistory()
 	searchData.Timer.Init()
@@ -213,6 +406,8 @@ func StartUCIProtocolInterface() {
 			UCICommandReponse()
 		case "isready":
 			isReadyCommandReponse()
+		case "setoption":
+			setOptionCommandReponse(&searchData, &tokens)
 		case "ucinewgame":
 			UCINewGameCommandReponse(&searchData, &gameData)
 		case "position":
@@ -221,6 +416,10 @@ func StartUCIProtocolInterface() {
 			go goCommandReponse(&searchData, &gameData, &tokens)
 		case "stop":
 			stopCommandReponse(&searchData)
+		case "ponderhit":
+			ponderHitCommandReponse(&searchData)
+		case "eval":
+			evalCommandReponse(&searchData)
 		case "quit":
 			return
 		}